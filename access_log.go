@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// results of a proxied connection or request
+const (
+	accessResultOK            = "ok"
+	accessResultRejected      = "rejected"
+	accessResultDialFailed    = "dial_failed"
+	accessResultTLSParseError = "tls_parse_error"
+	accessResultUpstreamReset = "upstream_reset"
+	accessResultKilled        = "killed"
+)
+
+var accessLog *AccessLog
+
+type accessRecordKey struct{}
+
+// AccessRecord describes a finished https connection or http request
+type AccessRecord struct {
+	Time      time.Time
+	Scheme    string
+	Listener  string
+	Client    string
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration
+	// http only
+	Method    string
+	Path      string
+	Proto     string
+	Status    int
+	Referer   string
+	UserAgent string
+
+	// the upstream address may be learned from another goroutine of the http transport, and the result may be set
+	// from the console killing the connection. The host and rule of an https connection are learned from its
+	// ClientHello while the console may already list it.
+	lock     sync.Mutex
+	host     string
+	rule     string
+	upstream string
+	result   string
+	err      error
+}
+
+func NewAccessRecord(scheme, listener, client string) *AccessRecord {
+	return &AccessRecord{
+		Time:     time.Now(),
+		Scheme:   scheme,
+		Listener: listener,
+		Client:   client,
+		result:   accessResultOK,
+	}
+}
+
+// SetHost records the requested host, the SNI or the Host header
+func (r *AccessRecord) SetHost(host string) {
+	r.lock.Lock()
+	r.host = host
+	r.lock.Unlock()
+}
+
+func (r *AccessRecord) Host() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.host
+}
+
+// SetRule records the name of the rule deciding the host
+func (r *AccessRecord) SetRule(rule string) {
+	r.lock.Lock()
+	r.rule = rule
+	r.lock.Unlock()
+}
+
+func (r *AccessRecord) Rule() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rule
+}
+
+// SetUpstream records the address actually connected to, the upstream proxy when tunneling
+func (r *AccessRecord) SetUpstream(addr string) {
+	r.lock.Lock()
+	r.upstream = addr
+	r.lock.Unlock()
+}
+
+func (r *AccessRecord) Upstream() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.upstream
+}
+
+// Fail sets the result, only the first failure is kept
+func (r *AccessRecord) Fail(result string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.result == accessResultOK {
+		r.result = result
+		r.err = err
+	}
+}
+
+func (r *AccessRecord) Result() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.result, r.err
+}
+
+// status is the http status, or the one an https result maps to for the common log formats
+func (r *AccessRecord) status() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+	result, _ := r.Result()
+	switch result {
+	case accessResultOK:
+		return 200
+	case accessResultRejected:
+		return 403
+	case accessResultTLSParseError:
+		return 400
+	}
+	return 502
+}
+
+func withAccessRecord(ctx context.Context, r *AccessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordKey{}, r)
+}
+
+func accessRecord(ctx context.Context) *AccessRecord {
+	r, _ := ctx.Value(accessRecordKey{}).(*AccessRecord)
+	return r
+}
+
+// AccessLog writes one line per finished connection or request to accesslog.file, in the format accesslog.format:
+// json, logfmt, common or combined. Without a file the records go to the operational log.
+type AccessLog struct {
+	lock   sync.Mutex
+	format string
+	out    *logFile
+}
+
+func NewAccessLog() *AccessLog {
+	ret := &AccessLog{}
+	if err := ret.Reload(viper.GetString("accesslog.file"), viper.GetString("accesslog.format")); err != nil {
+		logger.Fatalf("Unable to set up the access log, err %v", err)
+		return nil
+	}
+	return ret
+}
+
+func parseAccessLogFormat(format string) (string, error) {
+	format = strings.ToLower(strings.Trim(format, " "))
+	switch format {
+	case "json", "logfmt", "common", "combined":
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid accesslog.format %s, expecting json, logfmt, common or combined", format)
+}
+
+// Reload switches to another file and format, the file is reopened even if it stays the same
+func (l *AccessLog) Reload(fn, format string) error {
+	format, err := parseAccessLogFormat(format)
+	if err != nil {
+		return err
+	}
+	var out *logFile
+	if fn != "" {
+		if out, err = openLogFile(fn); err != nil {
+			return err
+		}
+	}
+	l.lock.Lock()
+	old := l.out
+	l.format, l.out = format, out
+	l.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// fields lists the record as key value pairs, in the order they are logged
+func (r *AccessRecord) fields() []interface{} {
+	result, err := r.Result()
+	ret := []interface{}{
+		"time", r.Time.Format(time.RFC3339Nano),
+		"scheme", r.Scheme,
+		"client", r.Client,
+		"host", r.Host(),
+		"rule", r.Rule(),
+		"upstream", r.Upstream(),
+		"result", result,
+		"bytes_up", r.BytesUp,
+		"bytes_down", r.BytesDown,
+		"duration_ms", float64(r.Duration.Microseconds()) / 1000,
+	}
+	if r.Scheme == "http" {
+		ret = append(ret, "method", r.Method, "path", r.Path, "status", r.Status)
+	}
+	if err != nil {
+		ret = append(ret, "error", err.Error())
+	}
+	return ret
+}
+
+func (l *AccessLog) Write(r *AccessRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.out == nil {
+		logger.Infow("access", r.fields()...)
+		return
+	}
+	var line []byte
+	switch l.format {
+	case "json":
+		line = formatAccessJSON(r)
+	case "logfmt":
+		line = formatAccessLogfmt(r)
+	default:
+		line = formatAccessCommon(r, l.format == "combined")
+	}
+	l.out.Write(append(line, '\n'))
+}
+
+func formatAccessJSON(r *AccessRecord) []byte {
+	return formatJSONFields(r.fields())
+}
+
+// formatJSONFields writes key value pairs as a JSON object, keeping their order
+func formatJSONFields(fields []interface{}) []byte {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		// Encode terminates each value with a newline
+		enc.Encode(fields[i])
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteByte(':')
+		enc.Encode(fields[i+1])
+		buf.Truncate(buf.Len() - 1)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+func formatAccessLogfmt(r *AccessRecord) []byte {
+	fields := r.fields()
+	parts := make([]string, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		v := fmt.Sprint(fields[i+1])
+		if v == "" || strings.ContainsAny(v, " \"=\\\t\r\n") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", fields[i], v))
+	}
+	return []byte(strings.Join(parts, " "))
+}
+
+// formatAccessCommon writes the NCSA common or combined format. An https connection is shown as a CONNECT to the
+// server name with a status derived from its result.
+func formatAccessCommon(r *AccessRecord, combined bool) []byte {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	client := r.Client
+	if host := hostOnly(client); host != "" {
+		client = host
+	}
+	request := fmt.Sprintf("CONNECT %s TLS", r.Host())
+	if r.Scheme == "http" {
+		request = fmt.Sprintf("%s %s %s", r.Method, r.Path, r.Proto)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %d", dash(client), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(request), r.status(), r.BytesDown)
+	if combined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(dash(r.Referer)), strconv.Quote(dash(r.UserAgent)))
+	}
+	return []byte(line)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// clientACL holds the *ClientACL in use, it is replaced on reload
+var clientACL atomic.Value
+
+// cidrACL is a pair of allow and deny lists. A deny match wins, an empty allow list lets in everybody not denied.
+type cidrACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseCIDRACL parses comma separated allow and deny lists, nil when both are empty
+func parseCIDRACL(allow, deny string) (*cidrACL, error) {
+	ret := &cidrACL{}
+	var err error
+	if ret.allow, err = parseCIDRList(allow); err != nil {
+		return nil, err
+	}
+	if ret.deny, err = parseCIDRList(deny); err != nil {
+		return nil, err
+	}
+	if len(ret.allow) == 0 && len(ret.deny) == 0 {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// Permits tells whether a client may connect, a nil list permits everybody. An unknown address only passes when
+// nothing is allowed explicitly.
+func (a *cidrACL) Permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.allow) == 0
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// ClientACL is the client access control of acl.allow and acl.deny, applying to all listeners, and of acl.listeners
+// for single listen addresses
+type ClientACL struct {
+	global    *cidrACL
+	listeners map[string]*cidrACL
+}
+
+type listenerACLConfig struct {
+	Listen string
+	Allow  string
+	Deny   string
+}
+
+func newClientACL(v *viper.Viper) (*ClientACL, error) {
+	global, err := parseCIDRACL(v.GetString("acl.allow"), v.GetString("acl.deny"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid acl, %w", err)
+	}
+	ret := &ClientACL{
+		global:    global,
+		listeners: map[string]*cidrACL{},
+	}
+	configs := []listenerACLConfig{}
+	if err := v.UnmarshalKey("acl.listeners", &configs); err != nil {
+		return nil, fmt.Errorf("invalid acl.listeners, %w", err)
+	}
+	for _, c := range configs {
+		listen := strings.Trim(c.Listen, " ")
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil, fmt.Errorf("invalid acl.listeners listen address %q, %w", c.Listen, err)
+		}
+		if _, ok := ret.listeners[listen]; ok {
+			return nil, fmt.Errorf("duplicate acl.listeners entry for %s", listen)
+		}
+		if ret.listeners[listen], err = parseCIDRACL(c.Allow, c.Deny); err != nil {
+			return nil, fmt.Errorf("invalid acl of listener %s, %w", listen, err)
+		}
+	}
+	return ret, nil
+}
+
+func currentClientACL() *ClientACL {
+	return clientACL.Load().(*ClientACL)
+}
+
+// Check returns the list denying a client on a listener, "global" or "listener", empty when it is let in
+func (a *ClientACL) Check(listener string, ip net.IP) string {
+	if !a.global.Permits(ip) {
+		return "global"
+	}
+	if !a.listeners[listener].Permits(ip) {
+		return "listener"
+	}
+	return ""
+}
+
+// rejectClient logs and counts a client turned away by the list named acl, and records it as rejected
+func rejectClient(rec *AccessRecord, acl string) {
+	logger.Infow("client rejected by acl", "scheme", rec.Scheme, "listener", rec.Listener, "client", rec.Client,
+		"host", rec.Host(), "acl", acl)
+	metrics.ConnectionErrors.Add(1, rec.Scheme, errorReason(errClientDenied))
+	metrics.ClientRejections.Add(1, rec.Scheme, acl)
+	rec.Fail(accessResultRejected, errClientDenied)
+}
+
+// clientAllowed applies the global and listener ACLs to the client of rec, before anything is read from it
+func clientAllowed(rec *AccessRecord, ip net.IP) bool {
+	if acl := currentClientACL().Check(rec.Listener, ip); acl != "" {
+		rejectClient(rec, acl)
+		return false
+	}
+	return true
+}
+
+// clientAllowedByRule applies the ACL of the rule deciding the requested host, once the host is known
+func clientAllowedByRule(rec *AccessRecord, ip net.IP, rule *HostRule) bool {
+	if rule != nil && !rule.Clients.Permits(ip) {
+		rejectClient(rec, "rule")
+		return false
+	}
+	return true
+}
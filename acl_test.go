@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// testConfig returns settings read from a yaml document
+func testConfig(t *testing.T, yaml string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatalf("ReadConfig err %v", err)
+	}
+	return v
+}
+
+func TestCIDRACLPermits(t *testing.T) {
+	tests := []struct {
+		allow string
+		deny  string
+		ip    string
+		want  bool
+	}{
+		{"", "", "192.0.2.1", true},
+		{"", "", "", true},
+		{"192.0.2.0/24", "", "192.0.2.1", true},
+		{"192.0.2.0/24", "", "198.51.100.1", false},
+		// an unknown address can't be told to be allowed
+		{"192.0.2.0/24", "", "", false},
+		{"", "192.0.2.1", "192.0.2.1", false},
+		{"", "192.0.2.1", "192.0.2.2", true},
+		{"", "192.0.2.1", "", true},
+		// a deny match wins
+		{"192.0.2.0/24", "192.0.2.128/25", "192.0.2.200", false},
+		{"192.0.2.0/24", "192.0.2.128/25", "192.0.2.100", true},
+		{"2001:db8::/32", "", "2001:db8::1", true},
+		{"2001:db8::/32", "", "192.0.2.1", false},
+		{"192.0.2.0/24", "", "::ffff:192.0.2.1", true},
+	}
+	for _, tt := range tests {
+		acl, err := parseCIDRACL(tt.allow, tt.deny)
+		if err != nil {
+			t.Fatalf("parseCIDRACL(%q, %q) err %v", tt.allow, tt.deny, err)
+		}
+		if got := acl.Permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allow %q deny %q: Permits(%q) = %v, want %v", tt.allow, tt.deny, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	acl, err := newClientACL(testConfig(t, `
+acl:
+  allow: "10.0.0.0/8,192.0.2.0/24,2001:db8::/32"
+  deny: "10.0.0.1"
+  listeners:
+    - listen: "127.0.0.1:18443"
+      deny: "10.0.5.0/24,10.1.0.0/16"
+    - listen: "127.0.0.1:18080"
+      allow: "192.0.2.0/25"
+`))
+	if err != nil {
+		t.Fatalf("newClientACL err %v", err)
+	}
+	rules := testForwardRules(t, `{
+  "yuanshen.com": {"allow_clients": "10.0.0.0/16,2001:db8::/48", "deny_clients": "10.0.0.2"},
+  "example.com": ""
+}`)
+	tests := []struct {
+		listener string
+		client   string
+		host     string
+		want     string // the list turning the client away
+	}{
+		{"127.0.0.1:18443", "10.2.0.1", "example.com", ""},
+		// global first, a deny beats an allow
+		{"127.0.0.1:18443", "10.0.0.1", "example.com", "global"},
+		{"127.0.0.1:18443", "203.0.113.1", "example.com", "global"},
+		{"127.0.0.1:18443", "", "example.com", "global"},
+		{"127.0.0.1:18443", "2001:db9::1", "example.com", "global"},
+		// then the listener, the other listener is not affected
+		{"127.0.0.1:18443", "10.1.2.3", "example.com", "listener"},
+		{"127.0.0.1:2080", "10.1.2.3", "example.com", ""},
+		{"127.0.0.1:18080", "10.1.2.3", "example.com", "listener"},
+		{"127.0.0.1:18080", "192.0.2.200", "example.com", "listener"},
+		{"127.0.0.1:18080", "192.0.2.1", "example.com", ""},
+		// then the rule
+		{"127.0.0.1:18443", "10.0.6.6", "www.yuanshen.com", ""},
+		{"127.0.0.1:18443", "2001:db8::1", "yuanshen.com", ""},
+		{"127.0.0.1:18443", "2001:db8:1::1", "yuanshen.com", "rule"},
+		{"127.0.0.1:18080", "192.0.2.1", "yuanshen.com", "rule"},
+		{"127.0.0.1:18443", "10.0.0.2", "yuanshen.com", "rule"},
+		// the rule can't let in who the global or listener lists keep out
+		{"127.0.0.1:18443", "10.0.0.1", "yuanshen.com", "global"},
+		{"127.0.0.1:18443", "10.0.5.5", "yuanshen.com", "listener"},
+		// hosts matching no rule have no rule list
+		{"127.0.0.1:18443", "10.2.0.1", "unknown.example.net", ""},
+	}
+	clientACL.Store(acl)
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.client)
+		rec := NewAccessRecord("https", tt.listener, tt.client)
+		got := acl.Check(tt.listener, ip)
+		if clientAllowed(rec, ip) != (got == "") {
+			t.Errorf("%s on %s: clientAllowed disagrees with Check %q", tt.client, tt.listener, got)
+		}
+		if got == "" && !clientAllowedByRule(rec, ip, rules.MatchHost(tt.host)) {
+			got = "rule"
+		}
+		if got != tt.want {
+			t.Errorf("%s on %s for %s: turned away by %q, want %q", tt.client, tt.listener, tt.host, got, tt.want)
+		}
+		if result, _ := rec.Result(); (result == accessResultRejected) != (got != "") {
+			t.Errorf("%s on %s for %s: recorded as %q", tt.client, tt.listener, tt.host, result)
+		}
+	}
+}
+
+func TestNewClientACLInvalid(t *testing.T) {
+	for _, yaml := range []string{
+		"acl:\n  allow: \"10.0.0.0/33\"\n",
+		"acl:\n  deny: \"example.com\"\n",
+		"acl:\n  listeners:\n    - listen: \"18443\"\n      deny: \"10.0.0.1\"\n",
+		"acl:\n  listeners:\n    - listen: \":18443\"\n      deny: \"10.0.0.1/8/8\"\n",
+		"acl:\n  listeners:\n    - listen: \":18443\"\n      deny: \"10.0.0.1\"\n    - listen: \" :18443\"\n      allow: \"10.0.0.2\"\n",
+		"acl:\n  listeners: \"10.0.0.1\"\n",
+	} {
+		if _, err := newClientACL(testConfig(t, yaml)); err == nil {
+			t.Errorf("newClientACL accepted\n%s", yaml)
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	cacheMaxHeuristicLifetime = 24 * time.Hour
+)
+
+var (
+	downloadCache *DownloadCache
+)
+
+// cacheEntry is a stored response, persisted as <hash>.meta next to the body in <hash>.data. The data file is sparse,
+// Segments records which byte ranges of it are actually present.
+type cacheEntry struct {
+	Key        string
+	URL        string
+	Host       string
+	Header     http.Header
+	Size       int64 // size of the whole object, -1 while a response without length is being stored
+	Segments   [][2]int64
+	StoredAt   time.Time
+	Expires    time.Time
+	LastAccess time.Time
+	Hits       int64
+	element    *list.Element
+	fills      []*cacheFillMark // ranges currently being fetched into the data file
+	cond       *sync.Cond       // broadcast whenever segments or fills change, uses the cache lock
+	transient  bool             // spool of a shared response that isn't indexed, see cache_coalesce.go
+	spool      *os.File
+	refs       int
+	failed     bool
+	flight     *cacheFlight
+}
+
+// cacheFillMark is a range some fetch is writing, readers wait for it instead of requesting the same bytes again
+type cacheFillMark struct {
+	start int64
+	end   int64
+}
+
+// filling tells whether some fetch is going to write pos
+func (e *cacheEntry) filling(pos int64) bool {
+	for _, m := range e.fills {
+		if m.start <= pos && pos < m.end {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadCache is an on-disk cache for the http proxy, implemented as a RoundTripper in front of the upstream
+// transport. Cacheable GET responses are stored while they are streamed to the client, keyed by host, path and the
+// query without the configured ignored parameters. Stale entries are revalidated with ETag/Last-Modified and the
+// least recently used entries are evicted once the total stored size exceeds the limit. Objects may be stored
+// partially, from range requests or interrupted downloads, missing parts are fetched when a client needs them.
+type DownloadCache struct {
+	dir            string
+	maxSize        int64
+	ignoreParams   map[string]bool
+	next           http.RoundTripper
+	lock           sync.Mutex
+	entries        map[string]*cacheEntry
+	lru            *list.List
+	size           int64
+	segments       int
+	segmentMinSize int64
+	hostLimit      int
+	hostSlots      map[string]chan struct{}
+	hostSlotsLock  sync.Mutex
+	flights        map[string]*cacheFlight
+	rules          *ForwardRules
+	hits           int64
+	misses         int64
+	coalesced      int64
+	prewarmWorkers int
+	jobs           map[string]*cachePrewarmJob
+	jobOrder       []string
+	jobSeq         int
+}
+
+func NewDownloadCache(next http.RoundTripper, rules *ForwardRules) *DownloadCache {
+	ret := &DownloadCache{
+		dir:            GetFileLocation(viper.GetString("cache.dir")),
+		maxSize:        int64(viper.GetSizeInBytes("cache.maxsize")),
+		ignoreParams:   map[string]bool{},
+		next:           next,
+		lock:           sync.Mutex{},
+		entries:        map[string]*cacheEntry{},
+		lru:            list.New(),
+		segments:       viper.GetInt("http.segments"),
+		segmentMinSize: int64(viper.GetSizeInBytes("http.segmentminsize")),
+		hostLimit:      viper.GetInt("http.segmenthostlimit"),
+		hostSlots:      map[string]chan struct{}{},
+		hostSlotsLock:  sync.Mutex{},
+		flights:        map[string]*cacheFlight{},
+		rules:          rules,
+		prewarmWorkers: viper.GetInt("cache.prewarmworkers"),
+		jobs:           map[string]*cachePrewarmJob{},
+		jobOrder:       []string{},
+	}
+	for _, s := range strings.Split(viper.GetString("cache.ignoreparams"), ",") {
+		s = strings.Trim(s, " ")
+		if s != "" {
+			ret.ignoreParams[s] = true
+		}
+	}
+	if err := os.MkdirAll(ret.dir, 0755); err != nil {
+		logger.Fatalf("Unable to create cache dir %s, err %v", ret.dir, err)
+		return nil
+	}
+	if err := ret.load(); err != nil {
+		logger.Fatalf("Load cache from %s failed, err %v", ret.dir, err)
+		return nil
+	}
+	ret.registerAPI()
+	logger.Infof("Cache initialized at %s, %d entries, %d bytes", ret.dir, len(ret.entries), ret.size)
+	return ret
+}
+
+// load rebuilds the index from the meta files on disk, least recently used first
+func (c *DownloadCache) load() error {
+	loaded := []*cacheEntry{}
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// leftover of an interrupted download
+			os.Remove(path)
+			return nil
+		}
+		if !strings.HasSuffix(path, ".meta") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e := &cacheEntry{}
+		if err := json.Unmarshal(data, e); err != nil || e.Key == "" {
+			logger.Warnf("Invalid cache meta %s, removing", path)
+			c.removeFiles(strings.TrimSuffix(path, ".meta"))
+			return nil
+		}
+		st, err := os.Stat(c.dataPath(e.Key))
+		if err != nil || e.Size < 0 || st.Size() != e.Size {
+			logger.Warnf("Cache data of %s is missing or truncated, removing", e.URL)
+			c.removeFiles(strings.TrimSuffix(path, ".meta"))
+			return nil
+		}
+		loaded = append(loaded, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].LastAccess.Before(loaded[j].LastAccess)
+	})
+	for _, e := range loaded {
+		e.cond = sync.NewCond(&c.lock)
+		e.element = c.lru.PushFront(e)
+		c.entries[e.Key] = e
+		c.size += segmentsLen(e.Segments)
+	}
+	return nil
+}
+
+func (c *DownloadCache) basePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, h[:2], h)
+}
+
+func (c *DownloadCache) dataPath(key string) string {
+	return c.basePath(key) + ".data"
+}
+
+func (c *DownloadCache) removeFiles(base string) {
+	os.Remove(base + ".data")
+	os.Remove(base + ".meta")
+}
+
+// Key returns the cache key of a request, the query is normalized and stripped of the ignored parameters
+func (c *DownloadCache) Key(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	key := strings.ToLower(host) + req.URL.EscapedPath()
+	query := req.URL.Query()
+	for p := range c.ignoreParams {
+		query.Del(p)
+	}
+	if len(query) != 0 {
+		key += "?" + query.Encode()
+	}
+	return key
+}
+
+func (c *DownloadCache) saveMeta(e *cacheEntry) error {
+	data, _ := json.Marshal(e)
+	fn := c.basePath(e.Key) + ".meta"
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// lookup returns the entry for key marking it as recently used, nil when there is none or it is still being created
+func (c *DownloadCache) lookup(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.Size < 0 {
+		return nil
+	}
+	c.lru.MoveToFront(e.element)
+	e.LastAccess = time.Now()
+	return e
+}
+
+// entryHeader returns a copy of the mutable parts of an entry needed to answer a request
+func (c *DownloadCache) entryHeader(e *cacheEntry) (http.Header, time.Time, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return e.Header.Clone(), e.StoredAt, e.Expires
+}
+
+func (c *DownloadCache) hit(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.Hits++
+	c.hits++
+}
+
+// create replaces whatever is stored for key with a new empty entry, returning it with its data file opened for
+// writing. Writers of a replaced entry keep their own handle on the unlinked file and their updates are dropped.
+func (c *DownloadCache) create(req *http.Request, key string, header http.Header, size int64) (*cacheEntry, *os.File, error) {
+	now := time.Now()
+	u := url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	e := &cacheEntry{
+		Key:        key,
+		URL:        u.String(),
+		Host:       strings.ToLower(req.Host),
+		Header:     header,
+		Size:       size,
+		Segments:   [][2]int64{},
+		StoredAt:   now,
+		Expires:    now.Add(freshnessLifetime(header, now)),
+		LastAccess: now,
+	}
+	e.cond = sync.NewCond(&c.lock)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if old, ok := c.entries[key]; ok {
+		// a concurrent fetch of the same version, like a range request racing a full one, keeps what's stored
+		if v := strongValidator(header); size >= 0 && old.Size == size && v != "" && strongValidator(old.Header) == v {
+			if f, err := os.OpenFile(c.dataPath(key), os.O_RDWR, 0644); err == nil {
+				old.Header = header
+				old.StoredAt = now
+				old.Expires = e.Expires
+				old.LastAccess = now
+				c.lru.MoveToFront(old.element)
+				return old, f, nil
+			}
+		}
+		c.removeLocked(old)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.basePath(key)), 0755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(c.dataPath(key), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if size > 0 {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			os.Remove(c.dataPath(key))
+			return nil, nil, err
+		}
+	}
+	if err := c.saveMeta(e); err != nil {
+		f.Close()
+		os.Remove(c.dataPath(key))
+		return nil, nil, err
+	}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+	return e, f, nil
+}
+
+// newFiller tees body into the data file of e from start on. [start, end) is marked as being filled until the filler
+// finishes, end is -1 when unknown. Without a data file, the body is passed through as is.
+func (c *DownloadCache) newFiller(body io.ReadCloser, e *cacheEntry, f *os.File, start, end int64) *cacheFiller {
+	ret := &cacheFiller{
+		body:   body,
+		offset: start,
+		cache:  c,
+		entry:  e,
+	}
+	if f == nil {
+		return ret
+	}
+	if end < 0 {
+		end = math.MaxInt64
+	}
+	ret.file = f
+	ret.mark = c.markFill(e, start, end)
+	return ret
+}
+
+func (c *DownloadCache) markFill(e *cacheEntry, start, end int64) *cacheFillMark {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := &cacheFillMark{start: start, end: end}
+	e.fills = append(e.fills, m)
+	return m
+}
+
+func (c *DownloadCache) unmarkFill(e *cacheEntry, m *cacheFillMark) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unmarkFillLocked(e, m)
+}
+
+func (c *DownloadCache) unmarkFillLocked(e *cacheEntry, m *cacheFillMark) {
+	for i, f := range e.fills {
+		if f == m {
+			e.fills = append(e.fills[:i:i], e.fills[i+1:]...)
+			break
+		}
+	}
+	e.cond.Broadcast()
+}
+
+// current tells whether e is still the indexed entry for its key, transient entries are always current. Must be
+// called with the lock held.
+func (c *DownloadCache) current(e *cacheEntry) bool {
+	return e.transient || c.entries[e.Key] == e
+}
+
+// openForWrite opens the data file of a current entry to fill a missing part
+func (c *DownloadCache) openForWrite(e *cacheEntry) *os.File {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[e.Key] != e {
+		return nil
+	}
+	f, err := os.OpenFile(c.dataPath(e.Key), os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Warnf("Open cache data of %s for writing failed, err %v", e.URL, err)
+		return nil
+	}
+	return f
+}
+
+// addSegment records [start, end) as present, it returns false once the entry is no longer the current one
+func (c *DownloadCache) addSegment(e *cacheEntry, start, end int64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.current(e) {
+		return false
+	}
+	if e.transient {
+		e.Segments = addSegment(e.Segments, start, end)
+		e.cond.Broadcast()
+		return true
+	}
+	old := segmentsLen(e.Segments)
+	e.Segments = addSegment(e.Segments, start, end)
+	c.size += segmentsLen(e.Segments) - old
+	e.cond.Broadcast()
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		victim := c.lru.Back().Value.(*cacheEntry)
+		logger.Debugf("Evicting %s from cache, %d bytes", victim.URL, segmentsLen(victim.Segments))
+		c.removeLocked(victim)
+	}
+	return c.entries[e.Key] == e
+}
+
+// flush ends a fill and persists the segments of the entry, size is set for objects whose length was unknown
+func (c *DownloadCache) flush(e *cacheEntry, m *cacheFillMark, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unmarkFillLocked(e, m)
+	if e.transient {
+		c.endSpoolLocked(e, size)
+		return
+	}
+	if c.entries[e.Key] != e {
+		return
+	}
+	if e.Size < 0 {
+		if size < 0 {
+			// a response without length didn't complete, nothing useful left
+			c.removeLocked(e)
+			return
+		}
+		e.Size = size
+	}
+	if err := c.saveMeta(e); err != nil {
+		logger.Warnf("Save cache meta of %s failed, err %v", e.URL, err)
+		c.removeLocked(e)
+		return
+	}
+	if segmentsLen(e.Segments) == e.Size {
+		logger.Infow("cached", "url", e.URL, "size", e.Size)
+	}
+}
+
+// available returns how many bytes starting at pos are present
+func (c *DownloadCache) available(e *cacheEntry, pos int64) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return segmentEnd(e.Segments, pos) - pos
+}
+
+// waitAvailable is like available, but when pos is being filled it waits for the data to arrive. 0 is returned when
+// nothing is going to fill pos. Readers call it before every chunk, so a request killed from the console or gone
+// stops here even when the rest is on disk already.
+func (c *DownloadCache) waitAvailable(ctx context.Context, e *cacheEntry, pos int64) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var done chan struct{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if avail := segmentEnd(e.Segments, pos) - pos; avail > 0 {
+			return avail, nil
+		}
+		if !c.current(e) || !e.filling(pos) {
+			return 0, nil
+		}
+		if done == nil {
+			// wake up when the client goes away
+			done = make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					c.lock.Lock()
+					e.cond.Broadcast()
+					c.lock.Unlock()
+				case <-done:
+				}
+			}()
+		}
+		e.cond.Wait()
+	}
+}
+
+// nextPresent returns where the next present or being filled range after pos starts, the object size if none
+func (c *DownloadCache) nextPresent(e *cacheEntry, pos int64) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := nextSegmentStart(e.Segments, pos, e.Size)
+	for _, m := range e.fills {
+		if m.start > pos && m.start < ret {
+			ret = m.start
+		}
+	}
+	return ret
+}
+
+func (c *DownloadCache) remove(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[e.Key] == e {
+		c.removeLocked(e)
+	}
+}
+
+func (c *DownloadCache) removeLocked(e *cacheEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.Key)
+	c.size -= segmentsLen(e.Segments)
+	c.removeFiles(c.basePath(e.Key))
+	e.cond.Broadcast()
+}
+
+// updateHeader merges the headers of a 304 into the stored entry and restarts its freshness lifetime
+func (c *DownloadCache) updateHeader(e *cacheEntry, h http.Header) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries[e.Key] != e {
+		return false
+	}
+	for k, v := range h {
+		if k == "Content-Length" || k == "Content-Range" || k == "X-Cache" {
+			continue
+		}
+		e.Header[k] = v
+	}
+	e.StoredAt = time.Now()
+	e.Expires = e.StoredAt.Add(freshnessLifetime(e.Header, e.StoredAt))
+	if err := c.saveMeta(e); err != nil {
+		logger.Warnf("Save cache meta of %s failed, err %v", e.URL, err)
+	}
+	return true
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	ret := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.Trim(d, " ")
+			if d == "" {
+				continue
+			}
+			if i := strings.Index(d, "="); i >= 0 {
+				ret[strings.ToLower(d[:i])] = strings.Trim(d[i+1:], "\"")
+			} else {
+				ret[strings.ToLower(d)] = ""
+			}
+		}
+	}
+	return ret
+}
+
+// freshnessLifetime follows RFC 7234 section 4.2.1, falling back to the 10% of Last-Modified age heuristic
+func freshnessLifetime(h http.Header, now time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+			return 0
+		}
+	}
+	date := now
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+	if h.Get("Expires") != "" {
+		exp, err := http.ParseTime(h.Get("Expires"))
+		if err != nil || !exp.After(date) {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+		lifetime := date.Sub(lm) / 10
+		if lifetime > cacheMaxHeuristicLifetime {
+			lifetime = cacheMaxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// isPrivateResponse tells whether a response is meant for the client that asked for it alone
+func isPrivateResponse(h http.Header) bool {
+	if h.Get("Set-Cookie") != "" {
+		return true
+	}
+	cc := parseCacheControl(h)
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isCacheableResponse(resp *http.Response) bool {
+	if (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent) || isPrivateResponse(resp.Header) {
+		return false
+	}
+	// entries are keyed by url only, Accept-Encoding is fine as long as the body isn't encoded
+	for _, v := range resp.Header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.Trim(f, " ")
+			if f != "" && (!strings.EqualFold(f, "Accept-Encoding") || resp.Header.Get("Content-Encoding") != "") {
+				return false
+			}
+		}
+	}
+	// no point keeping something that could neither be fresh nor revalidated
+	return freshnessLifetime(resp.Header, time.Now()) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+func (c *DownloadCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isCacheableRequest(req) {
+		return c.next.RoundTrip(req)
+	}
+	key := c.Key(req)
+	e := c.lookup(key)
+	if e == nil {
+		return c.fetch(req, key)
+	}
+	header, _, expires := c.entryHeader(e)
+	_, noCache := parseCacheControl(req.Header)["no-cache"]
+	if !noCache && time.Now().Before(expires) {
+		return c.serve(req, e)
+	}
+	if header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return c.fetch(req, key)
+	}
+	// stale, ask upstream whether our copy is still good
+	revalidate := req.Clone(req.Context())
+	revalidate.Header.Del("If-None-Match")
+	revalidate.Header.Del("If-Modified-Since")
+	revalidate.Header.Del("If-Range")
+	if etag := header.Get("ETag"); etag != "" {
+		revalidate.Header.Set("If-None-Match", etag)
+	}
+	if lm := header.Get("Last-Modified"); lm != "" {
+		revalidate.Header.Set("If-Modified-Since", lm)
+	}
+	resp, err := c.next.RoundTrip(revalidate)
+	if err != nil || resp.StatusCode >= 500 {
+		// upstream is in trouble, a stale copy is better than nothing
+		logger.Infow("cache revalidate fail, serving stale", "url", e.URL, "err", err)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return c.serve(req, e)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if c.updateHeader(e, resp.Header) {
+			return c.serve(req, e)
+		}
+		return c.fetch(req, key)
+	}
+	return c.store(req, key, resp), nil
+}
+
+// fetchDirect requests upstream without joining or starting a flight
+func (c *DownloadCache) fetchDirect(req *http.Request, key string) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.store(req, key, resp), nil
+}
+
+// store wraps the body of a cacheable response so that it is written to disk while the client reads it, a 206
+// creates a partial entry holding just that range
+func (c *DownloadCache) store(req *http.Request, key string, resp *http.Response) *http.Response {
+	c.lock.Lock()
+	c.misses++
+	c.lock.Unlock()
+	resp.Header.Set("X-Cache", "MISS")
+	if !isCacheableResponse(resp) {
+		return resp
+	}
+	start, size := int64(0), resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		first, last, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || total < 0 || (resp.ContentLength >= 0 && resp.ContentLength != last-first+1) {
+			return resp
+		}
+		start, size = first, total
+	}
+	header := resp.Header.Clone()
+	for _, h := range []string{"X-Cache", "Content-Range", "Content-Length", "Age"} {
+		header.Del(h)
+	}
+	e, f, err := c.create(req, key, header, size)
+	if err != nil {
+		logger.Warnf("Unable to create cache entry for %s, err %v", key, err)
+		return resp
+	}
+	if c.shouldSegment(resp, size) {
+		return c.fetchSegmented(req, resp, e, f)
+	}
+	end := int64(-1)
+	if resp.ContentLength >= 0 {
+		end = start + resp.ContentLength
+	}
+	resp.Body = c.newFiller(resp.Body, e, f, start, end)
+	return resp
+}
+
+// cacheFiller tees a response body into the data file of an entry starting at offset, recording what got stored
+type cacheFiller struct {
+	body   io.ReadCloser
+	file   *os.File
+	offset int64
+	cache  *DownloadCache
+	entry  *cacheEntry
+	mark   *cacheFillMark
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.body.Read(p)
+	if n > 0 && f.file != nil {
+		if _, werr := f.file.WriteAt(p[:n], f.offset); werr != nil {
+			logger.Warnf("Write cache file for %s failed, err %v", f.entry.URL, werr)
+			f.finish(false)
+		} else if !f.cache.addSegment(f.entry, f.offset, f.offset+int64(n)) {
+			// replaced or evicted meanwhile
+			f.finish(false)
+		}
+	}
+	f.offset += int64(n)
+	if err == io.EOF {
+		f.finish(true)
+	} else if err != nil {
+		f.finish(false)
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	f.finish(false)
+	return f.body.Close()
+}
+
+func (f *cacheFiller) finish(eof bool) {
+	if f.file == nil {
+		return
+	}
+	f.file.Close()
+	f.file = nil
+	size := int64(-1)
+	if eof {
+		size = f.offset
+	}
+	f.cache.flush(f.entry, f.mark, size)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheMaxPrewarmJobs = 100
+
+// cacheObject is an entry as listed by /cache/list
+type cacheObject struct {
+	URL        string    `json:"url"`
+	Size       int64     `json:"size"`
+	Stored     int64     `json:"stored"`
+	Hits       int64     `json:"hits"`
+	StoredAt   time.Time `json:"stored_at"`
+	Expires    time.Time `json:"expires"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+type cacheStats struct {
+	Entries   int     `json:"entries"`
+	DiskUsage int64   `json:"disk_usage"`
+	MaxSize   int64   `json:"max_size"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Coalesced int64   `json:"coalesced"`
+	HitRatio  float64 `json:"hit_ratio"`
+	InFlight  int     `json:"in_flight"`
+}
+
+type cachePrewarmError struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// cachePrewarmJob is a list of urls fetched into the cache in the background, guarded by the cache lock
+type cachePrewarmJob struct {
+	ID       string              `json:"id"`
+	Total    int                 `json:"total"`
+	Done     int                 `json:"done"`
+	Failed   int                 `json:"failed"`
+	Bytes    int64               `json:"bytes"`
+	Running  bool                `json:"running"`
+	Started  time.Time           `json:"started"`
+	Finished *time.Time          `json:"finished,omitempty"`
+	Errors   []cachePrewarmError `json:"errors"`
+	urls     []string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (c *DownloadCache) registerAPI() {
+	http.HandleFunc("/cache/list", c.handleList)
+	http.HandleFunc("/cache/stats", c.handleStats)
+	http.HandleFunc("/cache/purge", c.handlePurge)
+	http.HandleFunc("/cache/prewarm", c.handlePrewarm)
+	http.HandleFunc("/cache/prewarm/status", c.handlePrewarmStatus)
+}
+
+// urlKey returns the cache key an http url is stored under
+func (c *DownloadCache) urlKey(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return "", fmt.Errorf("only absolute http urls are cached, got %s", raw)
+	}
+	return c.Key(&http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: http.Header{}}), nil
+}
+
+// entryMatcher builds a filter on entries from the url, host or prefix query parameter, nil when none is given
+func (c *DownloadCache) entryMatcher(q url.Values) (func(e *cacheEntry) bool, error) {
+	if raw := q.Get("url"); raw != "" {
+		key, err := c.urlKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *cacheEntry) bool {
+			return e.Key == key
+		}, nil
+	}
+	if host := strings.ToLower(q.Get("host")); host != "" {
+		return func(e *cacheEntry) bool {
+			if e.Host == host {
+				return true
+			}
+			h, _, err := net.SplitHostPort(e.Host)
+			return err == nil && h == host
+		}, nil
+	}
+	if prefix := q.Get("prefix"); prefix != "" {
+		return func(e *cacheEntry) bool {
+			return strings.HasPrefix(e.URL, prefix)
+		}, nil
+	}
+	return nil, nil
+}
+
+// handleList lists entries most recently used first, optionally filtered like purge
+func (c *DownloadCache) handleList(w http.ResponseWriter, r *http.Request) {
+	match, err := c.entryMatcher(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c.lock.Lock()
+	ret := []cacheObject{}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		if match != nil && !match(e) {
+			continue
+		}
+		ret = append(ret, cacheObject{
+			URL:        e.URL,
+			Size:       e.Size,
+			Stored:     segmentsLen(e.Segments),
+			Hits:       e.Hits,
+			StoredAt:   e.StoredAt,
+			Expires:    e.Expires,
+			LastAccess: e.LastAccess,
+		})
+	}
+	c.lock.Unlock()
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (c *DownloadCache) handleStats(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	stats := cacheStats{
+		Entries:   len(c.entries),
+		DiskUsage: c.size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Coalesced: c.coalesced,
+		InFlight:  len(c.flights),
+	}
+	c.lock.Unlock()
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handlePurge removes the entries matching exactly one of the url, host or prefix parameters
+func (c *DownloadCache) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "purge needs POST"})
+		return
+	}
+	match, err := c.entryMatcher(r.URL.Query())
+	if err == nil && match == nil {
+		err = fmt.Errorf("one of url, host or prefix is required")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c.lock.Lock()
+	count, size := 0, int64(0)
+	for _, e := range c.entries {
+		if match(e) {
+			count++
+			size += segmentsLen(e.Segments)
+			c.removeLocked(e)
+		}
+	}
+	c.lock.Unlock()
+	logger.Infow("cache purged", "query", r.URL.RawQuery, "entries", count, "size", size)
+	writeJSON(w, http.StatusOK, map[string]int64{"purged": int64(count), "size": size})
+}
+
+// parsePrewarmList accepts a json array of urls or one url per line
+func parsePrewarmList(body []byte) ([]string, error) {
+	urls := []string{}
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		if err := json.Unmarshal(body, &urls); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if line := strings.Trim(scanner.Text(), " \t\r"); line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+	}
+	return urls, nil
+}
+
+// handlePrewarm starts a background job fetching the posted urls into the cache and returns its id
+func (c *DownloadCache) handlePrewarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "prewarm needs POST"})
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	urls, err := parsePrewarmList(body)
+	if err == nil && len(urls) == 0 {
+		err = fmt.Errorf("no url given")
+	}
+	for _, u := range urls {
+		if err != nil {
+			break
+		}
+		_, err = c.urlKey(u)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c.lock.Lock()
+	c.jobSeq++
+	job := &cachePrewarmJob{
+		ID:      strconv.Itoa(c.jobSeq),
+		Total:   len(urls),
+		Running: true,
+		Started: time.Now(),
+		Errors:  []cachePrewarmError{},
+		urls:    urls,
+	}
+	c.jobs[job.ID] = job
+	c.jobOrder = append(c.jobOrder, job.ID)
+	for len(c.jobOrder) > cacheMaxPrewarmJobs && !c.jobs[c.jobOrder[0]].Running {
+		delete(c.jobs, c.jobOrder[0])
+		c.jobOrder = c.jobOrder[1:]
+	}
+	c.lock.Unlock()
+	logger.Infow("cache prewarm started", "id", job.ID, "urls", len(urls))
+	go c.runPrewarm(job)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": job.ID})
+}
+
+// handlePrewarmStatus reports the job given by id, or all known jobs
+func (c *DownloadCache) handlePrewarmStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if id == "" {
+		ret := []*cachePrewarmJob{}
+		for _, id := range c.jobOrder {
+			ret = append(ret, c.jobs[id])
+		}
+		writeJSON(w, http.StatusOK, ret)
+		return
+	}
+	job, ok := c.jobs[id]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such job"})
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (c *DownloadCache) runPrewarm(job *cachePrewarmJob) {
+	urls := make(chan string)
+	wg := sync.WaitGroup{}
+	workers := c.prewarmWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range urls {
+				n, err := c.prewarm(u)
+				c.lock.Lock()
+				job.Done++
+				job.Bytes += n
+				if err != nil {
+					job.Failed++
+					job.Errors = append(job.Errors, cachePrewarmError{URL: u, Error: err.Error()})
+				}
+				c.lock.Unlock()
+				if err != nil {
+					logger.Infow("cache prewarm fail", "id", job.ID, "url", u, "err", err)
+				}
+			}
+		}()
+	}
+	for _, u := range job.urls {
+		urls <- u
+	}
+	close(urls)
+	wg.Wait()
+	c.lock.Lock()
+	now := time.Now()
+	job.Running = false
+	job.Finished = &now
+	done, failed := job.Done, job.Failed
+	c.lock.Unlock()
+	logger.Infow("cache prewarm finished", "id", job.ID, "done", done, "failed", failed)
+}
+
+// prewarm fetches one url through the cache the way the http proxy would, returning the bytes downloaded
+func (c *DownloadCache) prewarm(raw string) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, raw, nil)
+	if err != nil {
+		return 0, err
+	}
+	if !c.rules.IsHostAllowed(hostOnly(req.Host)) {
+		return 0, errTargetRejected
+	}
+	req.URL.Host = c.rules.Upstream(req.Host, "80")
+	ctx := withUpstreamRule(withUpstreamVia(req.Context(), c.rules.Via(req.Host)), c.rules.MatchHost(hostOnly(req.Host)))
+	req = req.WithContext(ctx)
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get("X-Cache") == "HIT" {
+		return 0, nil
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if !c.visible(c.Key(req)) {
+		return n, fmt.Errorf("response is not cacheable")
+	}
+	return n, nil
+}
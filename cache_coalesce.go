@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheFlight is a miss being fetched from upstream. Identical requests arriving meanwhile wait for its response
+// headers instead of going upstream themselves, then read the entry it created, or share its spooled body when the
+// response didn't make it into the cache.
+type cacheFlight struct {
+	signature string
+	done      chan struct{} // closed once the response headers are in
+	doneOnce  sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	status    int
+	header    http.Header
+	length    int64
+	spool     *cacheEntry
+}
+
+func (fl *cacheFlight) publish() {
+	fl.doneOnce.Do(func() {
+		close(fl.done)
+	})
+}
+
+// detachedContext keeps the values of a request context but not its cancellation, so that a flight outlives the
+// client that started it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// flightSignature covers the request headers that change what upstream sends back, only requests agreeing on all of
+// them can share a response body. Cookie is one of them, a session never gets to read what was sent for another.
+func flightSignature(req *http.Request) string {
+	parts := []string{}
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "Accept-Encoding", "Cookie"} {
+		parts = append(parts, strings.Join(req.Header.Values(h), ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// fetch gets a miss from upstream, coalescing concurrent requests for the same key into a single upstream request
+func (c *DownloadCache) fetch(req *http.Request, key string) (*http.Response, error) {
+	c.lock.Lock()
+	if fl, ok := c.flights[key]; ok {
+		c.lock.Unlock()
+		return c.join(req, key, fl)
+	}
+	ctx, cancel := context.WithCancel(detachedContext{req.Context()})
+	fl := &cacheFlight{
+		signature: flightSignature(req),
+		done:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	c.flights[key] = fl
+	c.lock.Unlock()
+
+	resp, err := c.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		c.endFlight(key, fl)
+		cancel()
+		return nil, err
+	}
+	resp = c.store(req, key, resp)
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	if c.visible(key) {
+		// followers find the entry and wait on its fill marks
+		c.endFlight(key, fl)
+		return resp, nil
+	}
+	if isPrivateResponse(resp.Header) {
+		// personalized, followers go upstream for their own
+		c.endFlight(key, fl)
+		return resp, nil
+	}
+	ret, err := c.spool(req, key, fl, resp)
+	if err != nil {
+		logger.Warnf("Unable to spool response of %s for sharing, err %v", key, err)
+		c.endFlight(key, fl)
+		return resp, nil
+	}
+	return ret, nil
+}
+
+// join waits for the flight fl to get its response headers and answers req from whatever it produced
+func (c *DownloadCache) join(req *http.Request, key string, fl *cacheFlight) (*http.Response, error) {
+	select {
+	case <-fl.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if e := c.lookup(key); e != nil {
+		return c.serve(req, e)
+	}
+	if fl.signature == flightSignature(req) {
+		if resp := c.attach(req, fl); resp != nil {
+			return resp, nil
+		}
+	}
+	return c.fetchDirect(req, key)
+}
+
+func (c *DownloadCache) endFlight(key string, fl *cacheFlight) {
+	c.lock.Lock()
+	if c.flights[key] == fl {
+		delete(c.flights, key)
+	}
+	c.lock.Unlock()
+	fl.publish()
+}
+
+// visible tells whether lookup would find an entry for key
+func (c *DownloadCache) visible(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	return ok && e.Size >= 0
+}
+
+// spool tees the body of a response that isn't served from the cache, but isn't private either, into a temporary file,
+// so that followers can read it from the start while it is still arriving. The flight stays joinable until the body is
+// complete.
+func (c *DownloadCache) spool(req *http.Request, key string, fl *cacheFlight, resp *http.Response) (*http.Response, error) {
+	reader, err := ioutil.TempFile(c.dir, "spool-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	writer, err := os.OpenFile(reader.Name(), os.O_WRONLY, 0644)
+	if err != nil {
+		reader.Close()
+		os.Remove(reader.Name())
+		return nil, err
+	}
+	e := &cacheEntry{
+		Key:       key,
+		Size:      -1,
+		transient: true,
+		spool:     reader,
+		refs:      2, // the filler and the leading client
+		flight:    fl,
+	}
+	e.cond = sync.NewCond(&c.lock)
+	fl.status = resp.StatusCode
+	fl.header = resp.Header.Clone()
+	fl.length = resp.ContentLength
+	fl.spool = e
+	end := int64(math.MaxInt64)
+	if resp.ContentLength >= 0 {
+		end = resp.ContentLength
+	}
+	filler := c.newFiller(resp.Body, e, writer, 0, end)
+	fl.publish()
+	go drainFiller(filler, end)
+	return c.spoolResponse(req, fl, fl.header.Clone(), e), nil
+}
+
+// attach lets req read the spool of fl, nil if it is already gone or failed
+func (c *DownloadCache) attach(req *http.Request, fl *cacheFlight) *http.Response {
+	c.lock.Lock()
+	e := fl.spool
+	if e == nil || e.refs == 0 || e.failed || (fl.ctx.Err() != nil && e.Size < 0) {
+		c.lock.Unlock()
+		return nil
+	}
+	e.refs++
+	c.coalesced++
+	c.lock.Unlock()
+	header := fl.header.Clone()
+	header.Set("X-Cache", "COALESCED")
+	return c.spoolResponse(req, fl, header, e)
+}
+
+func (c *DownloadCache) spoolResponse(req *http.Request, fl *cacheFlight, header http.Header, e *cacheEntry) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fl.status, http.StatusText(fl.status)),
+		StatusCode:    fl.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &cacheSpoolReader{cache: c, entry: e, ctx: req.Context()},
+		ContentLength: fl.length,
+		Request:       req,
+	}
+}
+
+// endSpoolLocked records the outcome of the filler of a spool, size is -1 when the body didn't complete
+func (c *DownloadCache) endSpoolLocked(e *cacheEntry, size int64) {
+	if size < 0 {
+		e.failed = true
+	} else {
+		e.Size = size
+	}
+	if c.flights[e.Key] == e.flight {
+		delete(c.flights, e.Key)
+	}
+	e.flight.cancel()
+	c.releaseSpoolLocked(e)
+}
+
+// releaseSpoolLocked drops a reference to a spool. Once no client is reading anymore the upstream request is
+// abandoned, and the file goes away with the last reference.
+func (c *DownloadCache) releaseSpoolLocked(e *cacheEntry) {
+	e.refs--
+	if e.refs == 1 && len(e.fills) > 0 {
+		e.flight.cancel()
+	}
+	if e.refs == 0 {
+		e.spool.Close()
+		os.Remove(e.spool.Name())
+	}
+}
+
+// cacheSpoolReader streams a spool from the start, waiting for the filler to write more
+type cacheSpoolReader struct {
+	cache  *DownloadCache
+	entry  *cacheEntry
+	ctx    context.Context
+	pos    int64
+	closed bool
+}
+
+func (r *cacheSpoolReader) Read(p []byte) (int, error) {
+	avail, err := r.cache.waitAvailable(r.ctx, r.entry, r.pos)
+	if err != nil {
+		return 0, err
+	}
+	if avail == 0 {
+		r.cache.lock.Lock()
+		size, failed := r.entry.Size, r.entry.failed
+		r.cache.lock.Unlock()
+		if !failed && size >= 0 && r.pos >= size {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := r.entry.spool.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *cacheSpoolReader) Close() error {
+	r.cache.lock.Lock()
+	defer r.cache.lock.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.cache.releaseSpoolLocked(r.entry)
+	}
+	return nil
+}
+
+// cancelOnClose releases the context of a flight once its body is done with
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
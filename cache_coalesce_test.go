@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type testTransport func(req *http.Request) (*http.Response, error)
+
+func (f testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// testDownloadCache is a cache in a temporary dir in front of next, without the console API
+func testDownloadCache(t *testing.T, next http.RoundTripper) *DownloadCache {
+	return &DownloadCache{
+		dir:          t.TempDir(),
+		ignoreParams: map[string]bool{},
+		next:         next,
+		entries:      map[string]*cacheEntry{},
+		lru:          list.New(),
+		hostSlots:    map[string]chan struct{}{},
+		flights:      map[string]*cacheFlight{},
+		jobs:         map[string]*cachePrewarmJob{},
+	}
+}
+
+func TestFetchCoalescing(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		cookie   string
+		upstream int
+	}{
+		// not cacheable, without validators, but fine to share
+		{"public", http.Header{}, "session=alice", 1},
+		{"set cookie", http.Header{"Set-Cookie": {"session=alice"}}, "session=alice", 2},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, "session=alice", 2},
+		{"no store", http.Header{"Cache-Control": {"no-store"}}, "session=alice", 2},
+		{"another session", http.Header{}, "session=bob", 2},
+	}
+	for _, tt := range tests {
+		lock := sync.Mutex{}
+		bodies := []*io.PipeWriter{}
+		c := testDownloadCache(t, testTransport(func(req *http.Request) (*http.Response, error) {
+			// the body stays open, the first response is still in flight when the second request comes
+			r, w := io.Pipe()
+			lock.Lock()
+			bodies = append(bodies, w)
+			lock.Unlock()
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        tt.header.Clone(),
+				Body:          r,
+				ContentLength: -1,
+				Request:       req,
+			}, nil
+		}))
+		first, _ := http.NewRequest(http.MethodGet, "http://dl.example.com/file", nil)
+		first.Header.Set("Cookie", "session=alice")
+		second, _ := http.NewRequest(http.MethodGet, "http://dl.example.com/file", nil)
+		second.Header.Set("Cookie", tt.cookie)
+		resp1, err := c.RoundTrip(first)
+		if err != nil {
+			t.Fatalf("%s: first request err %v", tt.name, err)
+		}
+		resp2, err := c.RoundTrip(second)
+		if err != nil {
+			t.Fatalf("%s: second request err %v", tt.name, err)
+		}
+		lock.Lock()
+		if len(bodies) != tt.upstream {
+			t.Errorf("%s: %d upstream requests, want %d", tt.name, len(bodies), tt.upstream)
+		}
+		for _, w := range bodies {
+			w.Close()
+		}
+		lock.Unlock()
+		shared := resp2.Header.Get("X-Cache") == "COALESCED"
+		if shared != (tt.upstream == 1) {
+			t.Errorf("%s: second response X-Cache %q", tt.name, resp2.Header.Get("X-Cache"))
+		}
+		resp1.Body.Close()
+		resp2.Body.Close()
+	}
+}
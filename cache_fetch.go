@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// shouldSegment tells whether a fresh miss is large enough to be fetched with parallel range requests
+func (c *DownloadCache) shouldSegment(resp *http.Response, size int64) bool {
+	return c.segments > 1 && resp.StatusCode == http.StatusOK && size >= c.segmentMinSize && size > 0 &&
+		strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes") && strongValidator(resp.Header) != ""
+}
+
+// acquireHostSlot limits how many segment requests run against one host at the same time
+func (c *DownloadCache) acquireHostSlot(ctx context.Context, host string) bool {
+	if c.hostLimit <= 0 {
+		return true
+	}
+	c.hostSlotsLock.Lock()
+	slots, ok := c.hostSlots[host]
+	if !ok {
+		slots = make(chan struct{}, c.hostLimit)
+		c.hostSlots[host] = slots
+	}
+	c.hostSlotsLock.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *DownloadCache) releaseHostSlot(host string) {
+	if c.hostLimit <= 0 {
+		return
+	}
+	c.hostSlotsLock.Lock()
+	slots := c.hostSlots[host]
+	c.hostSlotsLock.Unlock()
+	<-slots
+}
+
+// fetchSegmented splits the download of a new entry into c.segments parts. The response already received keeps
+// streaming the first part, the others are requested in parallel, and the client reads the entry in order as the
+// parts land on disk. The other parts are fetched to completion even if the client leaves, so they still get cached.
+func (c *DownloadCache) fetchSegmented(req *http.Request, resp *http.Response, e *cacheEntry, f *os.File) *http.Response {
+	reader, err := os.Open(c.dataPath(e.Key))
+	if err != nil {
+		logger.Warnf("Open cache data of %s failed, err %v", e.URL, err)
+		f.Close()
+		c.remove(e)
+		return resp
+	}
+	size := e.Size
+	segLen := (size + int64(c.segments) - 1) / int64(c.segments)
+	first := c.newFiller(resp.Body, e, f, 0, segLen)
+	go drainFiller(first, segLen)
+	validator := strongValidator(resp.Header)
+	etag := resp.Header.Get("ETag")
+	for start := segLen; start < size; start += segLen {
+		end := start + segLen
+		if end > size {
+			end = size
+		}
+		// mark before returning, so the client waits for the part instead of fetching it itself
+		m := c.markFill(e, start, end)
+		go c.fetchSegment(req, e, m, validator, etag)
+	}
+	logger.Infow("segmented fetch", "url", e.URL, "size", size, "segments", c.segments)
+	resp.Body = &cacheRangeReader{
+		cache: c,
+		entry: e,
+		req:   req,
+		file:  reader,
+		pos:   0,
+		end:   size,
+	}
+	return resp
+}
+
+func (c *DownloadCache) fetchSegment(req *http.Request, e *cacheEntry, m *cacheFillMark, validator string, etag string) {
+	// keeps the route of the request but not its cancellation
+	ctx := detachedContext{req.Context()}
+	if !c.acquireHostSlot(ctx, e.Host) {
+		c.unmarkFill(e, m)
+		return
+	}
+	defer c.releaseHostSlot(e.Host)
+	sreq := req.Clone(ctx)
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		sreq.Header.Del(h)
+	}
+	sreq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", m.start, m.end-1))
+	sreq.Header.Set("If-Range", validator)
+	resp, err := c.next.RoundTrip(sreq)
+	if err != nil {
+		logger.Infow("segment fetch fail", "url", e.URL, "start", m.start, "err", err)
+		c.unmarkFill(e, m)
+		return
+	}
+	first, _, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || first != m.start || (etag != "" && resp.Header.Get("ETag") != etag) {
+		logger.Infow("segment fetch got unexpected response", "url", e.URL, "start", m.start, "status", resp.StatusCode)
+		resp.Body.Close()
+		c.unmarkFill(e, m)
+		return
+	}
+	f := c.openForWrite(e)
+	if f == nil {
+		resp.Body.Close()
+		c.unmarkFill(e, m)
+		return
+	}
+	// the filler takes over the range, drop the placeholder only after it is registered
+	filler := c.newFiller(resp.Body, e, f, m.start, m.end)
+	c.unmarkFill(e, m)
+	drainFiller(filler, m.end)
+}
+
+// drainFiller stores a response body up to end, stopping early once the entry is gone
+func drainFiller(f *cacheFiller, end int64) {
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	for f.offset < end && f.file != nil {
+		if _, err := f.Read(buf); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segments are sorted, non overlapping, non adjacent [start, end) ranges
+
+func addSegment(segs [][2]int64, start, end int64) [][2]int64 {
+	if start >= end {
+		return segs
+	}
+	ret := make([][2]int64, 0, len(segs)+1)
+	for _, s := range segs {
+		if s[1] < start || s[0] > end {
+			ret = append(ret, s)
+			continue
+		}
+		// overlapping or adjacent, merge into the new one
+		if s[0] < start {
+			start = s[0]
+		}
+		if s[1] > end {
+			end = s[1]
+		}
+	}
+	ret = append(ret, [2]int64{start, end})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i][0] < ret[j][0]
+	})
+	return ret
+}
+
+func segmentsLen(segs [][2]int64) int64 {
+	var ret int64
+	for _, s := range segs {
+		ret += s[1] - s[0]
+	}
+	return ret
+}
+
+// segmentEnd returns the end of the segment containing pos, or pos itself when pos is in a hole
+func segmentEnd(segs [][2]int64, pos int64) int64 {
+	for _, s := range segs {
+		if s[0] <= pos && pos < s[1] {
+			return s[1]
+		}
+	}
+	return pos
+}
+
+func nextSegmentStart(segs [][2]int64, pos int64, size int64) int64 {
+	for _, s := range segs {
+		if s[0] > pos {
+			return s[0]
+		}
+	}
+	return size
+}
+
+// parseRange parses a Range header against an object of size bytes into [start, end) ranges. ok is false when the
+// header is malformed and should be ignored, an empty result means none of the ranges is satisfiable.
+func parseRange(header string, size int64) ([][2]int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, false
+	}
+	ret := [][2]int64{}
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.Trim(spec, " ")
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, false
+		}
+		first, last := strings.Trim(spec[:i], " "), strings.Trim(spec[i+1:], " ")
+		if first == "" {
+			// suffix range, the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ret = append(ret, [2]int64{size - n, size})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, false
+		}
+		end := size
+		if last != "" {
+			l, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || l < start {
+				return nil, false
+			}
+			if l+1 < end {
+				end = l + 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ret = append(ret, [2]int64{start, end})
+	}
+	return ret, true
+}
+
+// parseContentRange parses "bytes first-last/total", total is -1 when unknown
+func parseContentRange(header string) (int64, int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, false
+	}
+	header = header[len("bytes "):]
+	slash := strings.Index(header, "/")
+	dash := strings.Index(header, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, false
+	}
+	first, err1 := strconv.ParseInt(header[:dash], 10, 64)
+	last, err2 := strconv.ParseInt(header[dash+1:slash], 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, 0, false
+	}
+	total := int64(-1)
+	if header[slash+1:] != "*" {
+		t, err := strconv.ParseInt(header[slash+1:], 10, 64)
+		if err != nil || t <= last {
+			return 0, 0, 0, false
+		}
+		total = t
+	}
+	return first, last, total, true
+}
+
+// strongValidator returns a validator usable in If-Range
+func strongValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// ifRangeMatches tells whether a range request could be answered with a part of what we have
+func ifRangeMatches(ifRange string, h http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == h.Get("ETag")
+	}
+	return ifRange == h.Get("Last-Modified")
+}
+
+// serve answers a request from an entry, with a 206 for a single range. Parts of the object that are missing are
+// fetched from upstream and stored on the way.
+func (c *DownloadCache) serve(req *http.Request, e *cacheEntry) (*http.Response, error) {
+	header, storedAt, _ := c.entryHeader(e)
+	start, end := int64(0), e.Size
+	status := http.StatusOK
+	if rng := req.Header.Get("Range"); rng != "" && ifRangeMatches(req.Header.Get("If-Range"), header) {
+		ranges, ok := parseRange(rng, e.Size)
+		if ok && len(ranges) == 0 {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+			return newCacheResponse(req, http.StatusRequestedRangeNotSatisfiable, header, http.NoBody, 0), nil
+		}
+		if ok && len(ranges) > 1 {
+			// multipart byteranges are rare enough to leave to upstream
+			return c.next.RoundTrip(req)
+		}
+		if ok {
+			start, end = ranges[0][0], ranges[0][1]
+			status = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, e.Size))
+		}
+	}
+	if etag := header.Get("ETag"); status == http.StatusOK && etag != "" && req.Header.Get("If-None-Match") == etag {
+		c.hit(e)
+		return newCacheResponse(req, http.StatusNotModified, header, http.NoBody, 0), nil
+	}
+	f, err := os.Open(c.dataPath(e.Key))
+	if err != nil {
+		logger.Warnf("Open cache data of %s failed, err %v", e.URL, err)
+		c.remove(e)
+		return c.fetch(req, e.Key)
+	}
+	c.hit(e)
+	header.Set("Age", strconv.FormatInt(int64(time.Since(storedAt)/time.Second), 10))
+	if c.available(e, start) >= end-start {
+		header.Set("X-Cache", "HIT")
+	} else {
+		header.Set("X-Cache", "PARTIAL")
+	}
+	body := &cacheRangeReader{
+		cache: c,
+		entry: e,
+		req:   req,
+		file:  f,
+		pos:   start,
+		end:   end,
+	}
+	return newCacheResponse(req, status, header, body, end-start), nil
+}
+
+func newCacheResponse(req *http.Request, status int, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+// cacheRangeReader streams [pos, end) of an entry, reading present segments from disk, waiting for the ones some other
+// fetch is filling, and filling the remaining holes from upstream
+type cacheRangeReader struct {
+	cache   *DownloadCache
+	entry   *cacheEntry
+	req     *http.Request
+	file    *os.File
+	pos     int64
+	end     int64
+	hole    io.ReadCloser
+	holeEnd int64
+}
+
+func (r *cacheRangeReader) Read(p []byte) (int, error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+	if r.hole == nil {
+		avail, err := r.cache.waitAvailable(r.req.Context(), r.entry, r.pos)
+		if err != nil {
+			return 0, err
+		}
+		if avail > 0 {
+			if avail > r.end-r.pos {
+				avail = r.end - r.pos
+			}
+			if int64(len(p)) > avail {
+				p = p[:avail]
+			}
+			n, err := r.file.ReadAt(p, r.pos)
+			r.pos += int64(n)
+			if err == io.EOF && n == len(p) {
+				err = nil
+			}
+			return n, err
+		}
+		if err := r.openHole(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.holeEnd-r.pos {
+		p = p[:r.holeEnd-r.pos]
+	}
+	n, err := r.hole.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.holeEnd {
+		err = io.ErrUnexpectedEOF
+	}
+	if r.pos >= r.holeEnd || err == io.EOF {
+		r.hole.Close()
+		r.hole = nil
+		err = nil
+	}
+	return n, err
+}
+
+// openHole requests the missing bytes from pos up to the next present segment, guarded by If-Range so that a changed
+// object isn't stitched onto the stored one
+func (r *cacheRangeReader) openHole() error {
+	holeEnd := r.cache.nextPresent(r.entry, r.pos)
+	if holeEnd > r.end {
+		holeEnd = r.end
+	}
+	header, _, _ := r.cache.entryHeader(r.entry)
+	req := r.req.Clone(r.req.Context())
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.pos, holeEnd-1))
+	if v := strongValidator(header); v != "" {
+		req.Header.Set("If-Range", v)
+	}
+	resp, err := r.cache.next.RoundTrip(req)
+	if err != nil {
+		logger.Infow("cache fill fail", "url", r.entry.URL, "err", err)
+		return err
+	}
+	first, last, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || first != r.pos ||
+		(header.Get("ETag") != "" && resp.Header.Get("ETag") != header.Get("ETag")) {
+		resp.Body.Close()
+		logger.Infow("cache fill got a different object, dropping entry", "url", r.entry.URL, "status", resp.StatusCode)
+		r.cache.remove(r.entry)
+		return errCacheObjectChanged
+	}
+	if last+1 < holeEnd {
+		holeEnd = last + 1
+	}
+	r.holeEnd = holeEnd
+	r.hole = r.cache.newFiller(resp.Body, r.entry, r.cache.openForWrite(r.entry), r.pos, holeEnd)
+	return nil
+}
+
+func (r *cacheRangeReader) Close() error {
+	if r.hole != nil {
+		r.hole.Close()
+		r.hole = nil
+	}
+	return r.file.Close()
+}
@@ -1,51 +1,149 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var (
-	logger                *zap.SugaredLogger
-	errInvaildClientHello = errors.New("invalid TLS ClientHello data")
-	errInvalidTLSPacket   = errors.New("invalid TLS packet data")
-	errInvalidTLSProtocol = errors.New("invalid TLS protocol")
-	errTargetRejected     = errors.New("target host rejected")
+	logger                    *zap.SugaredLogger
+	logOutput                 *logFile
+	errOutput                 *logFile
+	errInvaildClientHello     = errors.New("invalid TLS ClientHello data")
+	errInvalidTLSPacket       = errors.New("invalid TLS packet data")
+	errInvalidTLSProtocol     = errors.New("invalid TLS protocol")
+	errTargetRejected         = errors.New("target host rejected")
+	errClientDenied           = errors.New("client address denied")
+	errDestinationBlocked     = errors.New("upstream destination blocked")
+	errInvalidDNSMessage      = errors.New("invalid DNS message")
+	errForwardLoop            = errors.New("forwarding loop detected")
+	errCacheObjectChanged     = errors.New("cached object changed upstream")
+	errInvalidProxyProtocol   = errors.New("invalid PROXY protocol header")
+	errProxyProtocolUntrusted = errors.New("PROXY protocol needs proxyprotocol.trusted, 0.0.0.0/0,::/0 trusts all")
+	errUpstreamProxy          = errors.New("upstream proxy refused the connection")
+	errConnectionKilled       = errors.New("connection killed from the console")
+	errShuttingDown           = errors.New("server shutting down")
 )
 var (
 	configName = flag.String("config", "rproxy.yaml", "")
 )
 
-func setupLog() {
-	logpath := viper.GetString("global.logfile")
-	errpath := viper.GetString("global.errfile")
-	config := zap.NewProductionConfig()
-	if logpath != "" {
-		config.OutputPaths = []string{
-			logpath,
-		}
+// logFile is a log destination that can be reopened, to follow log rotation or a new path without a restart
+type logFile struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	ret := &logFile{}
+	if err := ret.Reopen(path); err != nil {
+		return nil, err
 	}
-	if errpath != "" {
-		config.ErrorOutputPaths = []string{
-			errpath,
+	return ret, nil
+}
+
+// Reopen switches to path, empty or "stderr" means stderr, "stdout" stdout
+func (l *logFile) Reopen(path string) error {
+	f := os.Stderr
+	switch path {
+	case "", "stderr":
+	case "stdout":
+		f = os.Stdout
+	default:
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return err
 		}
 	}
-	logbase, _ := config.Build()
+	l.lock.Lock()
+	old := l.file
+	l.path, l.file = path, f
+	l.lock.Unlock()
+	closeLogFile(old)
+	return nil
+}
+
+// Close closes the file unless it is stdout or stderr
+func (l *logFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return closeLogFile(l.file)
+}
+
+func closeLogFile(f *os.File) error {
+	if f == nil || f == os.Stdout || f == os.Stderr {
+		return nil
+	}
+	return f.Close()
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Write(p)
+}
+
+func (l *logFile) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Sync()
+}
+
+func setupLog() {
+	var err error
+	if logOutput, err = openLogFile(viper.GetString("global.logfile")); err != nil {
+		panic(fmt.Errorf("unable to open global.logfile: %s", err))
+	}
+	if errOutput, err = openLogFile(viper.GetString("global.errfile")); err != nil {
+		panic(fmt.Errorf("unable to open global.errfile: %s", err))
+	}
+	// same as zap's production config, with outputs that can be reopened
+	config := zap.NewProductionConfig()
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config.EncoderConfig), logOutput, config.Level)
+	core = zapcore.NewSampler(core, time.Second, config.Sampling.Initial, config.Sampling.Thereafter)
+	logbase := zap.New(core, zap.ErrorOutput(errOutput), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
 	logger = logbase.Sugar()
 }
 
-func setupDefaults() {
-	viper.SetDefault("global.root", filepath.Dir(os.Args[0]))
-	viper.SetDefault("https.listen", ":443")
-	viper.SetDefault("http.listen", ":80")
-	viper.SetDefault("console.listen", ":2080")
+// reopenLogs reopens the log files at their configured paths
+func reopenLogs(logpath, errpath string) error {
+	if err := logOutput.Reopen(logpath); err != nil {
+		return err
+	}
+	return errOutput.Reopen(errpath)
+}
+
+func setupDefaults(v *viper.Viper) {
+	v.SetDefault("global.root", filepath.Dir(os.Args[0]))
+	v.SetDefault("global.draintimeout", "30s")
+	v.SetDefault("https.listen", ":443")
+	v.SetDefault("http.listen", ":80")
+	v.SetDefault("console.listen", ":2080")
+	v.SetDefault("dns.ttl", 60)
+	v.SetDefault("resolver.timeout", "5s")
+	v.SetDefault("resolver.negativettl", "30s")
+	v.SetDefault("cache.maxsize", "10GB")
+	v.SetDefault("cache.prewarmworkers", 4)
+	v.SetDefault("proxyprotocol.timeout", "5s")
+	v.SetDefault("accesslog.format", "json")
+	v.SetDefault("destination.blockprivate", true)
+	v.SetDefault("client.rulesbackups", 5)
+	v.SetDefault("client.ruleshistorymax", 500)
+	v.SetDefault("http.segments", 1)
+	v.SetDefault("http.segmentminsize", "16MB")
+	v.SetDefault("http.segmenthostlimit", 16)
 }
 func setupConfig() {
 	flag.Parse()
@@ -53,7 +151,7 @@ func setupConfig() {
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
 	viper.AddConfigPath(filepath.Dir(os.Args[0]))
-	setupDefaults()
+	setupDefaults(viper.GetViper())
 	var err error
 	if err = viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -64,13 +162,32 @@ func setupConfig() {
 	}
 }
 
-func startDefaultHTTPServer() {
+// startDefaultHTTPServer serves the console, the server is returned so that it can be stopped once an upgraded process
+// took over
+func startDefaultHTTPServer() *http.Server {
+	l, err := listenTCP(viper.GetString("console.listen"))
+	if err != nil {
+		logger.Panicf("Unable to listen to %s, err %v", viper.GetString("console.listen"), err)
+	}
+	tlsConfig, err := consoleTLSConfig()
+	if err != nil {
+		logger.Fatalf("Invalid console.tls, err %v", err)
+		return nil
+	}
+	consoleAuth = NewConsoleAuth(http.DefaultServeMux, tlsConfig != nil && tlsConfig.ClientCAs != nil)
+	server := &http.Server{
+		Handler:  consoleAuth,
+		ErrorLog: zap.NewStdLog(logger.Desugar()),
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 	go func() {
-		err := http.ListenAndServe(viper.GetString("console.listen"), nil)
-		if err != nil {
-			logger.Panicf("Unable to listen to %s, err %v", viper.GetString("console.listen"), err)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			logger.Panicf("Unable to serve %s, err %v", viper.GetString("console.listen"), err)
 		}
 	}()
+	return server
 }
 
 func GetFileLocation(fn string) string {
@@ -84,6 +201,8 @@ func GetFileLocation(fn string) string {
 	return fn
 }
 
-func LogAccess(protocol, from, to string) {
-	logger.Infow("access", "scheme", protocol, "from", from, "to", to)
+// LogAccess writes the completion record of a connection or request
+func LogAccess(r *AccessRecord) {
+	r.Duration = time.Since(r.Time)
+	accessLog.Write(r)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var connections *ConnectionRegistry
+
+// liveConnection is an https tunnel or http request in progress. The proxies add what it takes to close it and to
+// count its bytes as they get to know them.
+type liveConnection struct {
+	id      uint64
+	rec     *AccessRecord
+	lock    sync.Mutex
+	closers []func()
+	up      func() int64
+	down    func() int64
+	killed  bool
+}
+
+// Track adds a function ending the connection, and byte counters, up or down may be nil to keep the current one. A
+// closer added after the connection was killed is run right away.
+func (c *liveConnection) Track(closer func(), up, down func() int64) {
+	c.lock.Lock()
+	killed := c.killed
+	c.closers = append(c.closers, closer)
+	if up != nil {
+		c.up = up
+	}
+	if down != nil {
+		c.down = down
+	}
+	c.lock.Unlock()
+	if killed {
+		closer()
+	}
+}
+
+func (c *liveConnection) bytes() (int64, int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var up, down int64
+	if c.up != nil {
+		up = c.up()
+	}
+	if c.down != nil {
+		down = c.down()
+	}
+	return up, down
+}
+
+func (c *liveConnection) kill(err error) {
+	c.rec.Fail(accessResultKilled, err)
+	c.lock.Lock()
+	c.killed = true
+	closers := c.closers
+	c.lock.Unlock()
+	for _, f := range closers {
+		f()
+	}
+}
+
+// liveConnectionInfo is a connection as listed by /connections/list
+type liveConnectionInfo struct {
+	ID        uint64    `json:"id"`
+	Scheme    string    `json:"scheme"`
+	Listener  string    `json:"listener"`
+	Client    string    `json:"client"`
+	Host      string    `json:"host"`
+	Rule      string    `json:"rule"`
+	Upstream  string    `json:"upstream"`
+	Started   time.Time `json:"started"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// ConnectionRegistry keeps track of the active connections, so that the console can list them and close them
+type ConnectionRegistry struct {
+	lock  sync.Mutex
+	seq   uint64
+	conns map[uint64]*liveConnection
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	ret := &ConnectionRegistry{
+		lock:  sync.Mutex{},
+		conns: map[uint64]*liveConnection{},
+	}
+	http.HandleFunc("/connections/list", ret.handleList)
+	http.HandleFunc("/connections/kill", ret.handleKill)
+	return ret
+}
+
+// Add registers the connection described by rec, it must be removed once over
+func (r *ConnectionRegistry) Add(rec *AccessRecord) *liveConnection {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seq++
+	ret := &liveConnection{id: r.seq, rec: rec}
+	r.conns[ret.id] = ret
+	return ret
+}
+
+func (r *ConnectionRegistry) Remove(c *liveConnection) {
+	r.lock.Lock()
+	delete(r.conns, c.id)
+	r.lock.Unlock()
+}
+
+// KillListener closes the connections accepted on a listener, when it is shutting down
+func (r *ConnectionRegistry) KillListener(scheme, listener string) int {
+	r.lock.Lock()
+	conns := []*liveConnection{}
+	for _, c := range r.conns {
+		if c.rec.Scheme == scheme && c.rec.Listener == listener {
+			conns = append(conns, c)
+		}
+	}
+	r.lock.Unlock()
+	for _, c := range conns {
+		c.kill(errShuttingDown)
+	}
+	return len(conns)
+}
+
+// matching returns the connections selected by one of the id, client (an IP address) or host parameters, all of them
+// when none is given unless a filter is required
+func (r *ConnectionRegistry) matching(q url.Values, required bool) ([]*liveConnection, error) {
+	get := func(k string) string {
+		return strings.Trim(q.Get(k), " ")
+	}
+	var match func(c *liveConnection) bool
+	if id := get("id"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %s", id)
+		}
+		match = func(c *liveConnection) bool {
+			return c.id == n
+		}
+	} else if client := get("client"); client != "" {
+		match = func(c *liveConnection) bool {
+			return hostOnly(c.rec.Client) == client
+		}
+	} else if host := strings.Trim(strings.ToLower(get("host")), "."); host != "" {
+		match = func(c *liveConnection) bool {
+			return strings.Trim(strings.ToLower(hostOnly(c.rec.Host())), ".") == host
+		}
+	}
+	if match == nil && required {
+		return nil, fmt.Errorf("one of id, client or host is required")
+	}
+	r.lock.Lock()
+	ret := []*liveConnection{}
+	for _, c := range r.conns {
+		if match == nil || match(c) {
+			ret = append(ret, c)
+		}
+	}
+	r.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].id < ret[j].id
+	})
+	return ret, nil
+}
+
+// handleList lists the active connections oldest first, filtered like kill
+func (r *ConnectionRegistry) handleList(w http.ResponseWriter, req *http.Request) {
+	conns, err := r.matching(req.URL.Query(), false)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ret := []liveConnectionInfo{}
+	for _, c := range conns {
+		up, down := c.bytes()
+		ret = append(ret, liveConnectionInfo{
+			ID:        c.id,
+			Scheme:    c.rec.Scheme,
+			Listener:  c.rec.Listener,
+			Client:    c.rec.Client,
+			Host:      c.rec.Host(),
+			Rule:      c.rec.Rule(),
+			Upstream:  c.rec.Upstream(),
+			Started:   c.rec.Time,
+			BytesUp:   up,
+			BytesDown: down,
+		})
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// handleKill closes the connections matching one of the id, client or host parameters
+func (r *ConnectionRegistry) handleKill(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "kill needs POST"})
+		return
+	}
+	conns, err := r.matching(req.URL.Query(), true)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, c := range conns {
+		c.kill(errConnectionKilled)
+	}
+	logger.Infow("connections killed", "query", req.URL.RawQuery, "count", len(conns))
+	writeJSON(w, http.StatusOK, map[string]int{"killed": len(conns)})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	consoleRoleReadOnly = "readonly"
+	consoleRoleAdmin    = "admin"
+	// Django's format, pbkdf2_sha256$<iterations>$<salt>$<base64 of the 32 byte key>
+	consolePasswordScheme = "pbkdf2_sha256"
+)
+
+// consoleReadOnlyPaths may be read with the readonly role, everything else needs admin
+var consoleReadOnlyPaths = map[string]bool{
+	"/config/get":           true,
+	"/metrics":              true,
+	"/cache/list":           true,
+	"/cache/stats":          true,
+	"/cache/prewarm/status": true,
+	"/connections/list":     true,
+	"/rules/rule":           true,
+	"/rules/history":        true,
+}
+
+var consoleAuth *ConsoleAuth
+
+type consoleIdentityKey struct{}
+
+type consoleTokenConfig struct {
+	Name  string
+	Token string
+	Role  string
+}
+
+type consoleUserConfig struct {
+	Name     string
+	Password string
+	Role     string
+}
+
+type consoleCertConfig struct {
+	CN   string
+	Role string
+}
+
+type consoleUser struct {
+	role       string
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+type consoleToken struct {
+	name string
+	role string
+}
+
+// consoleCredentials are the accepted tokens, users and client certificates of console.tokens, console.users and
+// console.certs. With none of them configured the console is open.
+type consoleCredentials struct {
+	tokens map[[sha256.Size]byte]consoleToken // by hash of the token
+	users  map[string]*consoleUser
+	certs  map[string]string // common name -> role
+	// passwords checked once, so that scripts polling the console don't pay for PBKDF2 on every request
+	verified sync.Map
+}
+
+func parseConsoleRole(role string) (string, error) {
+	switch strings.ToLower(strings.Trim(role, " ")) {
+	case consoleRoleReadOnly, "read-only", "ro":
+		return consoleRoleReadOnly, nil
+	case consoleRoleAdmin:
+		return consoleRoleAdmin, nil
+	}
+	return "", fmt.Errorf("invalid console role %q, expecting readonly or admin", role)
+}
+
+// parseConsolePassword parses a pbkdf2_sha256 hash
+func parseConsolePassword(s string) (*consoleUser, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 4 || parts[0] != consolePasswordScheme {
+		return nil, fmt.Errorf("password is not a %s hash", consolePasswordScheme)
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("invalid %s iterations %q", consolePasswordScheme, parts[1])
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) != sha256.Size {
+		return nil, fmt.Errorf("invalid %s hash", consolePasswordScheme)
+	}
+	return &consoleUser{iterations: iterations, salt: []byte(parts[2]), key: key}, nil
+}
+
+// pbkdf2SHA256 derives a key of one hash length as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	prf.Write(salt)
+	prf.Write(block)
+	u := prf.Sum(nil)
+	ret := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range ret {
+			ret[j] ^= u[j]
+		}
+	}
+	return ret
+}
+
+func newConsoleCredentials(v *viper.Viper) (*consoleCredentials, error) {
+	ret := &consoleCredentials{
+		tokens: map[[sha256.Size]byte]consoleToken{},
+		users:  map[string]*consoleUser{},
+		certs:  map[string]string{},
+	}
+	tokens := []consoleTokenConfig{}
+	if err := v.UnmarshalKey("console.tokens", &tokens); err != nil {
+		return nil, fmt.Errorf("invalid console.tokens, %w", err)
+	}
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("console.tokens entry %d has no token", i)
+		}
+		role, err := parseConsoleRole(t.Role)
+		if err != nil {
+			return nil, err
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token%d", i)
+		}
+		ret.tokens[sha256.Sum256([]byte(t.Token))] = consoleToken{name: t.Name, role: role}
+	}
+	users := []consoleUserConfig{}
+	if err := v.UnmarshalKey("console.users", &users); err != nil {
+		return nil, fmt.Errorf("invalid console.users, %w", err)
+	}
+	for _, u := range users {
+		if u.Name == "" || strings.Contains(u.Name, ":") {
+			return nil, fmt.Errorf("invalid console user name %q", u.Name)
+		}
+		user, err := parseConsolePassword(u.Password)
+		if err != nil {
+			return nil, fmt.Errorf("console user %s, %w", u.Name, err)
+		}
+		if user.role, err = parseConsoleRole(u.Role); err != nil {
+			return nil, err
+		}
+		ret.users[u.Name] = user
+	}
+	certs := []consoleCertConfig{}
+	if err := v.UnmarshalKey("console.certs", &certs); err != nil {
+		return nil, fmt.Errorf("invalid console.certs, %w", err)
+	}
+	for _, c := range certs {
+		role, err := parseConsoleRole(c.Role)
+		if err != nil {
+			return nil, err
+		}
+		ret.certs[c.CN] = role
+	}
+	return ret, nil
+}
+
+func (c *consoleCredentials) required() bool {
+	return len(c.tokens)+len(c.users)+len(c.certs) > 0
+}
+
+func (c *consoleCredentials) checkPassword(name, password string) (string, error) {
+	user, ok := c.users[name]
+	if !ok {
+		return "", fmt.Errorf("unknown user %s", name)
+	}
+	sum := sha256.Sum256([]byte(password))
+	cacheKey := name + ":" + hex.EncodeToString(sum[:])
+	if _, ok := c.verified.Load(cacheKey); ok {
+		return user.role, nil
+	}
+	if subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), user.salt, user.iterations), user.key) != 1 {
+		return "", fmt.Errorf("wrong password for %s", name)
+	}
+	c.verified.Store(cacheKey, true)
+	return user.role, nil
+}
+
+// authenticate returns who sent a request and their role. A bearer token or basic auth header decides when present,
+// otherwise the client certificate does.
+func (c *consoleCredentials) authenticate(r *http.Request) (string, string, error) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		t, ok := c.tokens[sha256.Sum256([]byte(strings.Trim(auth[len("Bearer "):], " ")))]
+		if !ok {
+			return "", "", errors.New("invalid token")
+		}
+		return "token:" + t.name, t.role, nil
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		role, err := c.checkPassword(name, password)
+		return "user:" + name, role, err
+	}
+	if auth != "" {
+		return "", "", errors.New("unsupported authorization scheme")
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cn := r.TLS.PeerCertificates[0].Subject.CommonName
+		if role, ok := c.certs[cn]; ok || !c.required() {
+			if !ok {
+				role = consoleRoleAdmin
+			}
+			return "cert:" + cn, role, nil
+		}
+		return "cert:" + cn, "", fmt.Errorf("unknown client certificate %s", cn)
+	}
+	if !c.required() {
+		return "anonymous", consoleRoleAdmin, nil
+	}
+	return "", "", errors.New("no credentials")
+}
+
+// ConsoleAuth authenticates and authorizes the requests to the console, and writes failed attempts and changes made
+// through the console to console.auditlog
+type ConsoleAuth struct {
+	handler           http.Handler
+	requireClientCert bool
+	credentials       atomic.Value // *consoleCredentials
+	lock              sync.Mutex
+	audit             *logFile
+}
+
+func NewConsoleAuth(handler http.Handler, requireClientCert bool) *ConsoleAuth {
+	creds, err := newConsoleCredentials(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("Invalid console credentials, err %v", err)
+		return nil
+	}
+	ret := &ConsoleAuth{
+		handler:           handler,
+		requireClientCert: requireClientCert,
+	}
+	if err := ret.Reload(creds, viper.GetString("console.auditlog")); err != nil {
+		logger.Fatalf("Unable to open the console audit log, err %v", err)
+		return nil
+	}
+	if !creds.required() && !requireClientCert {
+		logger.Warnf("The console at %s has no authentication configured, anybody reaching it has admin access",
+			viper.GetString("console.listen"))
+	}
+	return ret
+}
+
+// Reload switches to new credentials and reopens the audit log
+func (a *ConsoleAuth) Reload(creds *consoleCredentials, auditFile string) error {
+	a.credentials.Store(creds)
+	var out *logFile
+	if auditFile != "" {
+		var err error
+		if out, err = openLogFile(auditFile); err != nil {
+			return err
+		}
+	}
+	a.lock.Lock()
+	old := a.audit
+	a.audit = out
+	a.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// consoleTLSConfig returns the TLS setup of console.tls, nil when the console is plain http
+func consoleTLSConfig() (*tls.Config, error) {
+	cert, key := viper.GetString("console.tls.cert"), viper.GetString("console.tls.key")
+	if cert == "" && key == "" {
+		if viper.GetString("console.tls.clientca") != "" {
+			return nil, errors.New("console.tls.clientca needs console.tls.cert and console.tls.key")
+		}
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(GetFileLocation(cert), GetFileLocation(key))
+	if err != nil {
+		return nil, err
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ca := viper.GetString("console.tls.clientca"); ca != "" {
+		pem, err := ioutil.ReadFile(GetFileLocation(ca))
+		if err != nil {
+			return nil, err
+		}
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+		// a missing certificate is refused by ServeHTTP, so that the attempt is audit logged
+		ret.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return ret, nil
+}
+
+// consoleIdentity returns who sent a console request, as in the audit log
+func consoleIdentity(r *http.Request) string {
+	who, _ := r.Context().Value(consoleIdentityKey{}).(string)
+	return who
+}
+
+func (a *ConsoleAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	readOnly := consoleReadOnlyPaths[r.URL.Path] && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+	if a.requireClientCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		a.auditLog(r, "", http.StatusUnauthorized, "no client certificate")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "client certificate required"})
+		return
+	}
+	creds := a.credentials.Load().(*consoleCredentials)
+	who, role, err := creds.authenticate(r)
+	if err != nil {
+		a.auditLog(r, who, http.StatusUnauthorized, err.Error())
+		if len(creds.users) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rproxy console"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rproxy console"`)
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	if role != consoleRoleAdmin && !readOnly {
+		a.auditLog(r, who, http.StatusForbidden, "needs the admin role")
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+		return
+	}
+	if !readOnly {
+		a.auditLog(r, who, 0, "")
+	}
+	a.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), consoleIdentityKey{}, who)))
+}
+
+// auditLog records a refused console request, or with status 0 one allowed to change something. Without
+// console.auditlog the records go to the operational log.
+func (a *ConsoleAuth) auditLog(r *http.Request, who string, status int, reason string) {
+	fields := []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"client", r.RemoteAddr,
+		"identity", who,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"query", r.URL.RawQuery,
+	}
+	result := "allowed"
+	if status != 0 {
+		result = "denied"
+		fields = append(fields, "status", status, "reason", reason)
+	}
+	fields = append(fields, "result", result)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.audit == nil {
+		if status != 0 {
+			logger.Warnw("console audit", fields...)
+		} else {
+			logger.Infow("console audit", fields...)
+		}
+		return
+	}
+	a.audit.Write(append(formatJSONFields(fields), '\n'))
+}
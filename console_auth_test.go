@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// the first 32 bytes of the PBKDF2-HMAC-SHA256 vectors of RFC 7914 section 11 and of the widely used ones
+	// completing the SHA-1 vectors of RFC 6070
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations))
+		if got != tt.key {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.key)
+		}
+	}
+}
+
+func TestParseConsolePassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		hash       string
+		ok         bool
+		iterations int
+		salt       string
+	}{
+		{"valid", "pbkdf2_sha256$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=", true, 1000, "seasalt"},
+		{"empty", "", false, 0, ""},
+		{"plain text", "hunter2", false, 0, ""},
+		{"other scheme", "pbkdf2_sha1$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=", false, 0, ""},
+		{"missing key", "pbkdf2_sha256$1000$seasalt", false, 0, ""},
+		{"extra part", "pbkdf2_sha256$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=$x", false, 0, ""},
+		{"bad iterations", "pbkdf2_sha256$many$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=", false, 0, ""},
+		{"zero iterations", "pbkdf2_sha256$0$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=", false, 0, ""},
+		{"negative iterations", "pbkdf2_sha256$-1$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=", false, 0, ""},
+		{"bad base64", "pbkdf2_sha256$1000$seasalt$not base64!", false, 0, ""},
+		{"truncated key", "pbkdf2_sha256$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9Bnnhg", false, 0, ""},
+		{"short key", "pbkdf2_sha256$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpQ==", false, 0, ""},
+	}
+	for _, tt := range tests {
+		user, err := parseConsolePassword(tt.hash)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseConsolePassword(%q) err %v, want ok %v", tt.name, tt.hash, err, tt.ok)
+			continue
+		}
+		if tt.ok && (user.iterations != tt.iterations || string(user.salt) != tt.salt) {
+			t.Errorf("%s: got %d iterations, salt %q", tt.name, user.iterations, user.salt)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	// made like Django's PBKDF2PasswordHasher does: the salt is used as text, the key is base64 encoded
+	hashes := map[string]string{
+		"alice": "pbkdf2_sha256$260000$Wq8mZ3pL0sXaQ1bc$AqucjpvKmKEl2UkBMaGPZVcGOD9zlvil2SpAl8hX4wg=",
+		"bob":   "pbkdf2_sha256$1000$seasalt$JgZryXe2Ga8ysg6XbzkLpTdyPQrHqsinbL9BnnhgX4A=",
+	}
+	creds := &consoleCredentials{users: map[string]*consoleUser{}}
+	for name, hash := range hashes {
+		user, err := parseConsolePassword(hash)
+		if err != nil {
+			t.Fatalf("parseConsolePassword(%q) err %v", hash, err)
+		}
+		user.role = consoleRoleAdmin
+		creds.users[name] = user
+	}
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"alice", "hunter2", true},
+		// once more, answered from the cache of verified passwords
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"alice", "", false},
+		{"bob", "lètmein", true},
+		{"bob", "letmein", false},
+		{"carol", "hunter2", false},
+	}
+	for _, tt := range tests {
+		role, err := creds.checkPassword(tt.user, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPassword(%q, %q) err %v, want ok %v", tt.user, tt.password, err, tt.ok)
+		}
+		if tt.ok && role != consoleRoleAdmin {
+			t.Errorf("checkPassword(%q, %q) role %q", tt.user, tt.password, role)
+		}
+	}
+}
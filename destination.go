@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// privateDestinations are refused by default: unspecified, RFC 1918, shared (carrier grade NAT, some cloud metadata),
+// loopback, link-local (cloud metadata at 169.254.169.254), multicast and reserved ranges, and their IPv6 counterparts
+const privateDestinations = "0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,172.16.0.0/12," +
+	"192.168.0.0/16,224.0.0.0/4,240.0.0.0/4,::/128,::1/128,fc00::/7,fe80::/10,ff00::/8"
+
+// destinationPolicy holds the *DestinationPolicy in use, it is replaced on reload
+var destinationPolicy atomic.Value
+
+type upstreamRuleKey struct{}
+
+// DestinationPolicy decides which addresses upstream connections may go to, so that a client can't make rproxy reach
+// the proxy host itself or its internal network with a crafted SNI or Host header
+type DestinationPolicy struct {
+	blocked []*net.IPNet
+	allowed []*net.IPNet
+}
+
+// newDestinationPolicy blocks the private ranges unless destination.blockprivate is off, plus destination.deny, and
+// exempts destination.allow
+func newDestinationPolicy(v *viper.Viper) (*DestinationPolicy, error) {
+	ret := &DestinationPolicy{}
+	if v.GetBool("destination.blockprivate") {
+		ret.blocked, _ = parseCIDRList(privateDestinations)
+	}
+	deny, err := parseCIDRList(v.GetString("destination.deny"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination.deny, %w", err)
+	}
+	ret.blocked = append(ret.blocked, deny...)
+	if ret.allowed, err = parseCIDRList(v.GetString("destination.allow")); err != nil {
+		return nil, fmt.Errorf("invalid destination.allow, %w", err)
+	}
+	return ret, nil
+}
+
+func currentDestinationPolicy() *DestinationPolicy {
+	return destinationPolicy.Load().(*DestinationPolicy)
+}
+
+// Permits tells whether ip may be dialed for a request decided by rule, which may be nil. A rule with a target is
+// trusted, the client doesn't pick where it goes, other rules are exempted for their allow_destinations.
+func (p *DestinationPolicy) Permits(ip net.IP, rule *HostRule) bool {
+	if !containsIP(p.blocked, ip) || containsIP(p.allowed, ip) {
+		return true
+	}
+	return rule != nil && rule.Allow && (rule.Target != "" || containsIP(rule.AllowDestinations, ip))
+}
+
+// destinationTrust is what Permits takes from rule, requests agreeing on it may share upstream connections
+func destinationTrust(rule *HostRule) string {
+	if rule == nil || !rule.Allow {
+		return ""
+	}
+	if rule.Target != "" {
+		return "target"
+	}
+	nets := []string{}
+	for _, n := range rule.AllowDestinations {
+		nets = append(nets, n.String())
+	}
+	return strings.Join(nets, ",")
+}
+
+// Check returns errDestinationBlocked unless all of ips may be dialed for the rule attached to ctx
+func (p *DestinationPolicy) Check(ctx context.Context, address string, ips []net.IP) error {
+	rule := upstreamRule(ctx)
+	for _, ip := range ips {
+		if !p.Permits(ip, rule) {
+			logger.Warnw("upstream destination blocked", "target", address, "ip", ip.String())
+			return fmt.Errorf("%w: %s", errDestinationBlocked, ip)
+		}
+	}
+	return nil
+}
+
+// withUpstreamRule attaches the rule deciding a request, for the destination policy of its upstream dial
+func withUpstreamRule(ctx context.Context, rule *HostRule) context.Context {
+	return context.WithValue(ctx, upstreamRuleKey{}, rule)
+}
+
+func upstreamRule(ctx context.Context) *HostRule {
+	r, _ := ctx.Value(upstreamRuleKey{}).(*HostRule)
+	return r
+}
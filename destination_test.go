@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+const testDestinationRules = `{
+  "target.example.com": "10.0.0.5",
+  "mirror.example.com": {"allow_destinations": "10.0.0.0/8,fd00::/8"},
+  "plain.example.com": "",
+  "!blocked.example.com": null
+}`
+
+func TestDestinationPolicyPermits(t *testing.T) {
+	rules := testForwardRules(t, testDestinationRules)
+	defaults := "destination:\n  blockprivate: true\n"
+	tests := []struct {
+		config string
+		ip     string
+		host   string // deciding the rule, empty for none
+		want   bool
+	}{
+		{defaults, "93.184.216.34", "", true},
+		{defaults, "2001:db8::1", "", true},
+		{defaults, "10.0.0.5", "", false},
+		{defaults, "127.0.0.1", "", false},
+		{defaults, "::ffff:127.0.0.1", "", false},
+		{defaults, "169.254.169.254", "", false},
+		{defaults, "100.64.0.1", "", false},
+		{defaults, "0.0.0.0", "", false},
+		{defaults, "224.0.0.1", "", false},
+		{defaults, "::1", "", false},
+		{defaults, "::", "", false},
+		{defaults, "fe80::1", "", false},
+		{defaults, "fd00::1", "", false},
+		// a target is trusted, allow_destinations exempts its ranges only
+		{defaults, "10.0.0.5", "target.example.com", true},
+		{defaults, "127.0.0.1", "target.example.com", true},
+		{defaults, "10.0.0.5", "mirror.example.com", true},
+		{defaults, "fd00::1", "mirror.example.com", true},
+		{defaults, "192.168.1.1", "mirror.example.com", false},
+		{defaults, "10.0.0.5", "plain.example.com", false},
+		{defaults, "10.0.0.5", "blocked.example.com", false},
+		{defaults, "93.184.216.34", "plain.example.com", true},
+		// destination.allow exempts from the built-in ranges and from destination.deny
+		{defaults + "  allow: \"10.20.0.0/16\"\n", "10.20.1.1", "", true},
+		{defaults + "  allow: \"10.20.0.0/16\"\n", "10.21.1.1", "", false},
+		{defaults + "  allow: \"169.254.0.0/16\"\n", "169.254.169.254", "", true},
+		{"destination:\n  deny: \"203.0.113.0/24\"\n  allow: \"203.0.113.7\"\n", "203.0.113.7", "", true},
+		{"destination:\n  deny: \"203.0.113.0/24\"\n  allow: \"203.0.113.7\"\n", "203.0.113.8", "", false},
+		// without the built-in ranges only destination.deny is blocked, which rules are exempted from as well
+		{"destination:\n  blockprivate: false\n", "10.0.0.5", "", true},
+		{"destination:\n  blockprivate: false\n  deny: \"203.0.113.0/24\"\n", "203.0.113.8", "", false},
+		{"destination:\n  blockprivate: false\n  deny: \"203.0.113.0/24\"\n", "203.0.113.8", "target.example.com", true},
+		{"destination:\n  blockprivate: false\n  deny: \"10.0.0.0/8\"\n", "10.0.0.5", "mirror.example.com", true},
+		{"destination:\n  blockprivate: false\n  deny: \"10.0.0.0/8\"\n", "10.0.0.5", "plain.example.com", false},
+	}
+	for _, tt := range tests {
+		p, err := newDestinationPolicy(testConfig(t, tt.config))
+		if err != nil {
+			t.Fatalf("newDestinationPolicy err %v\n%s", err, tt.config)
+		}
+		var rule *HostRule
+		if tt.host != "" {
+			rule = rules.MatchHost(tt.host)
+		}
+		if got := p.Permits(net.ParseIP(tt.ip), rule); got != tt.want {
+			t.Errorf("Permits(%s) for %q = %v, want %v\n%s", tt.ip, tt.host, got, tt.want, tt.config)
+		}
+	}
+}
+
+func TestDestinationPolicyCheck(t *testing.T) {
+	rules := testForwardRules(t, testDestinationRules)
+	p, err := newDestinationPolicy(testConfig(t, "destination:\n  blockprivate: true\n"))
+	if err != nil {
+		t.Fatalf("newDestinationPolicy err %v", err)
+	}
+	public, private := net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.5")
+	tests := []struct {
+		host string
+		ips  []net.IP
+		ok   bool
+	}{
+		{"", []net.IP{public}, true},
+		// one blocked address refuses them all
+		{"", []net.IP{public, private}, false},
+		{"plain.example.com", []net.IP{private, public}, false},
+		{"mirror.example.com", []net.IP{public, private}, true},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.host != "" {
+			ctx = withUpstreamRule(ctx, rules.MatchHost(tt.host))
+		}
+		err := p.Check(ctx, tt.host+":80", tt.ips)
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, errDestinationBlocked)) {
+			t.Errorf("Check(%q, %v) err %v, want ok %v", tt.host, tt.ips, err, tt.ok)
+		}
+	}
+}
+
+func TestNewDestinationPolicyInvalid(t *testing.T) {
+	for _, config := range []string{
+		"destination:\n  deny: \"10.0.0.0/33\"\n",
+		"destination:\n  allow: \"internal\"\n",
+	} {
+		if _, err := newDestinationPolicy(testConfig(t, config)); err == nil {
+			t.Errorf("newDestinationPolicy accepted\n%s", config)
+		}
+	}
+}
+
+func TestDestinationTrust(t *testing.T) {
+	rules := testForwardRules(t, testDestinationRules)
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"unknown.example.net", ""},
+		{"plain.example.com", ""},
+		{"blocked.example.com", ""},
+		{"target.example.com", "target"},
+		{"mirror.example.com", "10.0.0.0/8,fd00::/8"},
+	}
+	for _, tt := range tests {
+		if got := destinationTrust(rules.MatchHost(tt.host)); got != tt.want {
+			t.Errorf("destinationTrust for %s = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	dnsTypeA                  uint16 = 1
+	dnsTypeCNAME              uint16 = 5
+	dnsTypeAAAA               uint16 = 28
+	dnsTypeANY                uint16 = 255
+	dnsClassINET              uint16 = 1
+	dnsFlagResponse           uint16 = 1 << 15
+	dnsFlagAuthoritative      uint16 = 1 << 10
+	dnsFlagTruncated          uint16 = 1 << 9
+	dnsFlagRecursionDesired   uint16 = 1 << 8
+	dnsFlagRecursionAvailable uint16 = 1 << 7
+	dnsRcodeSuccess           uint16 = 0
+	dnsRcodeFormatError       uint16 = 1
+	dnsRcodeServerFailure     uint16 = 2
+	dnsRcodeNameError         uint16 = 3
+	dnsRcodeRefused           uint16 = 5
+	dnsHeaderLen                     = 12
+	dnsMaxPointerJumps               = 16
+)
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsResource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// dnsMessage only keeps the parts rproxy cares about, authority and additional sections are skipped when parsing
+type dnsMessage struct {
+	ID        uint16
+	Flags     uint16
+	Questions []dnsQuestion
+	Answers   []dnsResource
+}
+
+func (m *dnsMessage) Opcode() uint16 {
+	return (m.Flags >> 11) & 0xf
+}
+
+func (m *dnsMessage) Rcode() uint16 {
+	return m.Flags & 0xf
+}
+
+func appendNetworkInt(b []byte, v int, size int) []byte {
+	b = append(b, make([]byte, size)...)
+	writeNetworkInt(b[len(b)-size:], v)
+	return b
+}
+
+// readDNSName reads a possibly compressed domain name at off, returns the name and the offset right after it
+func readDNSName(data []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	jumps := 0
+	for {
+		if off >= len(data) {
+			return "", 0, errInvalidDNSMessage
+		}
+		l := int(data[off])
+		switch l & 0xc0 {
+		case 0x00:
+			if l == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, "."), next, nil
+			}
+			if off+1+l > len(data) {
+				return "", 0, errInvalidDNSMessage
+			}
+			labels = append(labels, string(data[off+1:off+1+l]))
+			off += 1 + l
+		case 0xc0:
+			if off+2 > len(data) || jumps >= dnsMaxPointerJumps {
+				return "", 0, errInvalidDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = makeNetworkInt(data[off:off+2]) & 0x3fff
+			jumps++
+		default:
+			return "", 0, errInvalidDNSMessage
+		}
+	}
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	name = strings.Trim(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > 63 {
+				label = label[:63]
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func parseDNSMessage(data []byte) (*dnsMessage, error) {
+	if len(data) < dnsHeaderLen {
+		return nil, errInvalidDNSMessage
+	}
+	m := &dnsMessage{
+		ID:    uint16(makeNetworkInt(data[0:2])),
+		Flags: uint16(makeNetworkInt(data[2:4])),
+	}
+	qdcount := makeNetworkInt(data[4:6])
+	ancount := makeNetworkInt(data[6:8])
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(data, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, errInvalidDNSMessage
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  uint16(makeNetworkInt(data[next : next+2])),
+			Class: uint16(makeNetworkInt(data[next+2 : next+4])),
+		})
+		off = next + 4
+	}
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(data, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(data) {
+			return nil, errInvalidDNSMessage
+		}
+		rdlen := makeNetworkInt(data[next+8 : next+10])
+		if next+10+rdlen > len(data) {
+			return nil, errInvalidDNSMessage
+		}
+		r := dnsResource{
+			Name:  name,
+			Type:  uint16(makeNetworkInt(data[next : next+2])),
+			Class: uint16(makeNetworkInt(data[next+2 : next+4])),
+			TTL:   uint32(makeNetworkInt(data[next+4 : next+8])),
+			Data:  data[next+10 : next+10+rdlen],
+		}
+		if r.Type == dnsTypeCNAME {
+			// CNAME targets could be compressed against the whole message, expand them here
+			target, _, err := readDNSName(data, next+10)
+			if err != nil {
+				return nil, err
+			}
+			r.Data = appendDNSName(nil, target)
+		}
+		m.Answers = append(m.Answers, r)
+		off = next + 10 + rdlen
+	}
+	return m, nil
+}
+
+// Pack encodes the message without name compression
+func (m *dnsMessage) Pack() []byte {
+	b := make([]byte, 0, 512)
+	b = appendNetworkInt(b, int(m.ID), 2)
+	b = appendNetworkInt(b, int(m.Flags), 2)
+	b = appendNetworkInt(b, len(m.Questions), 2)
+	b = appendNetworkInt(b, len(m.Answers), 2)
+	b = appendNetworkInt(b, 0, 2)
+	b = appendNetworkInt(b, 0, 2)
+	for _, q := range m.Questions {
+		b = appendDNSName(b, q.Name)
+		b = appendNetworkInt(b, int(q.Type), 2)
+		b = appendNetworkInt(b, int(q.Class), 2)
+	}
+	for _, r := range m.Answers {
+		b = appendDNSName(b, r.Name)
+		b = appendNetworkInt(b, int(r.Type), 2)
+		b = appendNetworkInt(b, int(r.Class), 2)
+		b = appendNetworkInt(b, int(r.TTL), 4)
+		b = appendNetworkInt(b, len(r.Data), 2)
+		b = append(b, r.Data...)
+	}
+	return b
+}
+
+// newDNSReply creates an empty reply for the request, carrying over the id, questions and the RD bit
+func newDNSReply(req *dnsMessage, rcode uint16) *dnsMessage {
+	return &dnsMessage{
+		ID:        req.ID,
+		Flags:     dnsFlagResponse | dnsFlagRecursionAvailable | req.Flags&dnsFlagRecursionDesired | req.Opcode()<<11 | rcode,
+		Questions: req.Questions,
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DNSServer answers queries for hijacked domains with the proxy's own addresses and forwards everything else
+type DNSServer struct {
+	rules    *ForwardRules
+	listen   string
+	upstream string
+	ipv4     []net.IP
+	ipv6     []net.IP
+	ttl      uint32
+	udp      net.PacketConn
+	tcp      net.Listener
+	closing  int32
+}
+
+func NewDNSServer(r *ForwardRules, listen string) *DNSServer {
+	ret := &DNSServer{
+		rules:    r,
+		listen:   listen,
+		upstream: strings.Trim(viper.GetString("dns.upstream"), " "),
+		ipv4:     []net.IP{},
+		ipv6:     []net.IP{},
+		ttl:      uint32(viper.GetInt("dns.ttl")),
+	}
+	if ret.upstream != "" {
+		if _, _, err := net.SplitHostPort(ret.upstream); err != nil {
+			ret.upstream = net.JoinHostPort(ret.upstream, "53")
+		}
+	}
+	for _, s := range strings.Split(viper.GetString("dns.address"), ",") {
+		s = strings.Trim(s, " ")
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			logger.Fatalf("Invalid dns answer address %s specified", s)
+			return nil
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ret.ipv4 = append(ret.ipv4, ip4)
+		} else {
+			ret.ipv6 = append(ret.ipv6, ip)
+		}
+	}
+	if len(ret.ipv4) == 0 && len(ret.ipv6) == 0 {
+		logger.Fatalf("DNS server enabled at %s but no dns.address configured", listen)
+		return nil
+	}
+	return ret
+}
+
+// answer builds the reply for a hijacked name, only A/AAAA (and ANY) get addresses, other types get an empty answer
+// so that clients won't learn the real address from records like HTTPS/SVCB
+func (c *DNSServer) answer(req *dnsMessage) *dnsMessage {
+	q := req.Questions[0]
+	reply := newDNSReply(req, dnsRcodeSuccess)
+	reply.Flags |= dnsFlagAuthoritative
+	add := func(t uint16, ips []net.IP) {
+		for _, ip := range ips {
+			reply.Answers = append(reply.Answers, dnsResource{
+				Name:  q.Name,
+				Type:  t,
+				Class: dnsClassINET,
+				TTL:   c.ttl,
+				Data:  ip,
+			})
+		}
+	}
+	if q.Type == dnsTypeA || q.Type == dnsTypeANY {
+		add(dnsTypeA, c.ipv4)
+	}
+	if q.Type == dnsTypeAAAA || q.Type == dnsTypeANY {
+		add(dnsTypeAAAA, c.ipv6)
+	}
+	return reply
+}
+
+func (c *DNSServer) forward(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, c.upstream, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// drop stray packets not answering our query
+			if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+	return exchangeDNSStream(conn, query)
+}
+
+// exchangeDNSStream sends a length prefixed query over a stream connection and reads the reply
+func exchangeDNSStream(conn net.Conn, query []byte) ([]byte, error) {
+	if _, err := conn.Write(appendNetworkInt(nil, len(query), 2)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	return readDNSStream(conn)
+}
+
+func readDNSStream(conn net.Conn) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(conn, l); err != nil {
+		return nil, err
+	}
+	data := make([]byte, makeNetworkInt(l))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *DNSServer) Handle(network string, from string, query []byte) []byte {
+	req, err := parseDNSMessage(query)
+	if err != nil {
+		logger.Debugf("Invalid dns query from %s, err %v", from, err)
+		if len(query) < dnsHeaderLen {
+			return nil
+		}
+		return newDNSReply(&dnsMessage{ID: uint16(makeNetworkInt(query[0:2]))}, dnsRcodeFormatError).Pack()
+	}
+	if req.Flags&dnsFlagResponse != 0 {
+		return nil
+	}
+	if req.Opcode() == 0 && len(req.Questions) == 1 && req.Questions[0].Class == dnsClassINET &&
+		c.rules.IsHostAllowedByRule(req.Questions[0].Name) {
+		logger.Debugw("dns hijack", "from", from, "name", req.Questions[0].Name, "type", req.Questions[0].Type)
+		return c.answer(req).Pack()
+	}
+	if c.upstream == "" {
+		return newDNSReply(req, dnsRcodeRefused).Pack()
+	}
+	reply, err := c.forward(network, query)
+	if err != nil {
+		logger.Infow("dns forward fail", "upstream", c.upstream, "err", err)
+		return newDNSReply(req, dnsRcodeServerFailure).Pack()
+	}
+	return reply
+}
+
+func (c *DNSServer) serveUDP(conn net.PacketConn) {
+	defer conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&c.closing) != 0 {
+				return
+			}
+			logger.Warnf("Error when reading dns query, error %v", err)
+			continue
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			if reply := c.Handle("udp", addr.String(), query); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+func (c *DNSServer) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readDNSStream(conn)
+		if err != nil {
+			return
+		}
+		reply := c.Handle("tcp", conn.RemoteAddr().String(), query)
+		if reply == nil {
+			return
+		}
+		if _, err := conn.Write(append(appendNetworkInt(nil, len(reply), 2), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *DNSServer) Start() error {
+	pc, err := listenUDP(c.listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen udp %s, %w", c.listen, err)
+	}
+	l, err := listenTCP(c.listen)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("unable to listen tcp %s, %w", c.listen, err)
+	}
+	c.udp, c.tcp = pc, l
+	logger.Infof("Initialize ok, start serving dns at %v", c.listen)
+	go c.serveUDP(pc)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if atomic.LoadInt32(&c.closing) != 0 {
+					return
+				}
+				logger.Warnf("Error when accepting, error %v", err)
+				continue
+			}
+			go c.serveTCP(conn)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the sockets, queries being answered are not waited for
+func (c *DNSServer) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&c.closing, 1)
+	c.udp.Close()
+	return c.tcp.Close()
+}
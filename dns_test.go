@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// testDNSResponse is an answer for www.example.com A, a CNAME to cdn.example.com and its address, both names in the
+// answers compressed against the question
+func testDNSResponse() []byte {
+	b := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0}
+	b = appendDNSName(b, "www.example.com")
+	b = append(b, 0, 1, 0, 1)
+	// www.example.com CNAME cdn.<example.com at offset 16>
+	b = append(b, 0xc0, 12, 0, 5, 0, 1, 0, 0, 0x0e, 0x10, 0, 6, 3, 'c', 'd', 'n', 0xc0, 16)
+	// cdn.example.com, pointing into the CNAME data at offset 45, A 192.0.2.1
+	b = append(b, 0xc0, 45, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+	return b
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	m, err := parseDNSMessage(testDNSResponse())
+	if err != nil {
+		t.Fatalf("parseDNSMessage err %v", err)
+	}
+	if m.ID != 0x1234 || m.Flags&dnsFlagResponse == 0 || m.Rcode() != dnsRcodeSuccess {
+		t.Errorf("header: id %x flags %x", m.ID, m.Flags)
+	}
+	if len(m.Questions) != 1 || m.Questions[0] != (dnsQuestion{"www.example.com", dnsTypeA, dnsClassINET}) {
+		t.Errorf("questions: %v", m.Questions)
+	}
+	if len(m.Answers) != 2 {
+		t.Fatalf("got %d answers, want 2", len(m.Answers))
+	}
+	cname, a := m.Answers[0], m.Answers[1]
+	if cname.Name != "www.example.com" || cname.Type != dnsTypeCNAME || cname.TTL != 3600 ||
+		!bytes.Equal(cname.Data, appendDNSName(nil, "cdn.example.com")) {
+		t.Errorf("CNAME answer: %+v", cname)
+	}
+	if a.Name != "cdn.example.com" || a.Type != dnsTypeA || a.TTL != 60 || !net.IP(a.Data).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("A answer: %+v", a)
+	}
+}
+
+func TestDNSMessagePack(t *testing.T) {
+	req := &dnsMessage{
+		ID:        7,
+		Flags:     dnsFlagRecursionDesired,
+		Questions: []dnsQuestion{{"dl.example.com.", dnsTypeAAAA, dnsClassINET}},
+	}
+	reply := newDNSReply(req, dnsRcodeSuccess)
+	reply.Answers = []dnsResource{{"dl.example.com", dnsTypeAAAA, dnsClassINET, 300, net.ParseIP("2001:db8::1")}}
+	m, err := parseDNSMessage(reply.Pack())
+	if err != nil {
+		t.Fatalf("parseDNSMessage err %v", err)
+	}
+	if m.ID != 7 || m.Flags&dnsFlagRecursionDesired == 0 || m.Flags&dnsFlagResponse == 0 {
+		t.Errorf("header: id %d flags %x", m.ID, m.Flags)
+	}
+	if len(m.Questions) != 1 || m.Questions[0].Name != "dl.example.com" || m.Questions[0].Type != dnsTypeAAAA {
+		t.Errorf("questions: %v", m.Questions)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].TTL != 300 || !net.IP(m.Answers[0].Data).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("answers: %v", m.Answers)
+	}
+}
+
+func TestParseDNSMessageInvalid(t *testing.T) {
+	header := func(qd, an byte) []byte {
+		return []byte{0, 1, 0, 0, 0, qd, 0, an, 0, 0, 0, 0}
+	}
+	question := append(appendDNSName(nil, "example.com"), 0, 1, 0, 1)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"short header", header(0, 0)[:11]},
+		{"missing question", header(1, 0)},
+		{"label past the end", append(header(1, 0), 10, 'e', 'x')},
+		{"missing root label", append(header(1, 0), 3, 'c', 'o', 'm')},
+		{"truncated question", append(header(1, 0), question[:len(question)-1]...)},
+		{"reserved label type", append(append(header(1, 0), 0x40, 0), 0, 1, 0, 1)},
+		{"extended label type", append(append(header(1, 0), 0x80, 0), 0, 1, 0, 1)},
+		{"truncated pointer", append(header(1, 0), 0xc0)},
+		{"pointer past the end", append(header(1, 0), 0xc0, 0xff, 0, 1, 0, 1)},
+		{"pointer loop", append(header(1, 0), 0xc0, 12, 0, 1, 0, 1)},
+		{"pointers to each other", append(header(1, 0), 0xc0, 14, 0xc0, 12, 0, 1, 0, 1)},
+		{"missing answer", append(header(1, 1), question...)},
+		{"truncated answer", append(append(header(1, 1), question...), 0xc0, 12, 0, 1, 0, 1, 0, 0, 0)},
+		{"rdata past the end", append(append(header(1, 1), question...), 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 1, 0, 4, 1, 2)},
+		{"invalid CNAME target", append(append(header(1, 1), question...), 0xc0, 12, 0, 5, 0, 1, 0, 0, 0, 1, 0, 2, 0xc0, 0xff)},
+	}
+	for _, tt := range tests {
+		if m, err := parseDNSMessage(tt.data); !errors.Is(err, errInvalidDNSMessage) {
+			t.Errorf("%s: parseDNSMessage = %v, %v, want %v", tt.name, m, err, errInvalidDNSMessage)
+		}
+	}
+	// every truncation of a valid message falls short of its counts
+	data := testDNSResponse()
+	for n := 0; n < len(data); n++ {
+		if _, err := parseDNSMessage(data[:n]); err == nil {
+			t.Errorf("truncated to %d of %d bytes: parseDNSMessage wants an error", n, len(data))
+		}
+	}
+}
+
+func TestReadDNSStream(t *testing.T) {
+	query := (&dnsMessage{ID: 1, Questions: []dnsQuestion{{"example.com", dnsTypeA, dnsClassINET}}}).Pack()
+	framed := append(appendNetworkInt(nil, len(query), 2), query...)
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []byte
+		err    error
+	}{
+		{"whole", framed, query, nil},
+		{"empty", []byte{}, nil, io.EOF},
+		{"truncated length", framed[:1], nil, io.ErrUnexpectedEOF},
+		{"truncated message", framed[:len(framed)-1], nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(tt.stream)
+			client.Close()
+		}()
+		got, err := readDNSStream(server)
+		server.Close()
+		if !errors.Is(err, tt.err) || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: readDNSStream = %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
-	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,59 +14,257 @@ import (
 	"github.com/spf13/viper"
 )
 
-type BoolMap map[string]bool
+type ruleKind int
+
+const (
+	ruleDomain   ruleKind = iota // example.com, the domain and all of its subdomains
+	ruleExact                    // =example.com, the domain only
+	ruleWildcard                 // *.example.com, subdomains only
+)
+
+// HostRule is a single parsed pattern of hosts.json
+type HostRule struct {
+	Pattern                string
+	Name                   string
+	Kind                   ruleKind
+	Allow                  bool
+	Target                 string // optional upstream override, "ip:port", "ip", "host" or "host:port"
+	ProxyProtocol          int    // PROXY protocol version sent upstream, 0 follows upstream.proxyprotocol, -1 is off
+	ProxyProtocolAuthority bool
+	Via                    string       // upstream proxy url or "direct", empty follows upstream.proxy
+	Clients                *cidrACL     // clients allowed to use the rule, nil for everybody
+	AllowDestinations      []*net.IPNet // exceptions from the destination policy
+}
+
+// RuleOptions is the object form of a hosts.json value, for rules needing more than an upstream target
+type RuleOptions struct {
+	Target                 string `json:"target,omitempty"`
+	ProxyProtocol          string `json:"proxy_protocol,omitempty"`
+	ProxyProtocolAuthority bool   `json:"proxy_protocol_authority,omitempty"`
+	Via                    string `json:"via,omitempty"`
+	AllowClients           string `json:"allow_clients,omitempty"`
+	DenyClients            string `json:"deny_clients,omitempty"`
+	AllowDestinations      string `json:"allow_destinations,omitempty"`
+}
+
+// RuleMap is a parsed rule set. Patterns in hosts.json take these forms:
+//
+//	example.com     example.com and all of its subdomains
+//	=example.com    example.com only
+//	*.example.com   subdomains of example.com, not example.com itself
+//	!<pattern>      excludes what <pattern> would match, e.g. !api.example.com
+//
+// The value of an allowing pattern optionally names the upstream to dial instead of the requested host, the port
+// of the request is kept when the target has none. It can also be a RuleOptions object.
+//
+// Precedence: an exact pattern for the host decides first, then the pattern naming the longest matching domain wins,
+// and between patterns naming the same domain an exclusion beats an allow. So "yuanshen.com" together with
+// "!api.yuanshen.com" allows everything under yuanshen.com except api.yuanshen.com and its subdomains.
+type RuleMap struct {
+	entries  map[string]json.RawMessage // pattern -> value, as in hosts.json
+	exact    map[string]*HostRule
+	domain   map[string]*HostRule
+	wildcard map[string]*HostRule
+}
+
+func NewRuleMap() *RuleMap {
+	return &RuleMap{
+		entries:  map[string]json.RawMessage{},
+		exact:    map[string]*HostRule{},
+		domain:   map[string]*HostRule{},
+		wildcard: map[string]*HostRule{},
+	}
+}
+
+func parseHostRule(pattern string) (*HostRule, error) {
+	rule := &HostRule{
+		Pattern: pattern,
+		Kind:    ruleDomain,
+		Allow:   true,
+	}
+	name := pattern
+	if strings.HasPrefix(name, "!") {
+		rule.Allow = false
+		name = name[1:]
+	}
+	if strings.HasPrefix(name, "=") {
+		rule.Kind = ruleExact
+		name = name[1:]
+	} else if strings.HasPrefix(name, "*.") {
+		rule.Kind = ruleWildcard
+		name = name[2:]
+	}
+	rule.Name = strings.Trim(name, ".")
+	if rule.Name == "" || strings.ContainsAny(rule.Name, "*=!/: ") {
+		return nil, fmt.Errorf("invalid host pattern %q", pattern)
+	}
+	return rule, nil
+}
+
+func parseRuleTarget(value string) (string, error) {
+	value = strings.Trim(value, " ")
+	if value == "" {
+		return "", nil
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		if host == "" {
+			return "", fmt.Errorf("invalid upstream target %q", value)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid upstream target port %q", value)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	if strings.ContainsAny(value, "/ ") {
+		return "", fmt.Errorf("invalid upstream target %q", value)
+	}
+	return strings.Trim(value, "[]"), nil
+}
+
+// parseRuleOptions accepts a target string, an options object or null
+func parseRuleOptions(value json.RawMessage) (*RuleOptions, error) {
+	opts := &RuleOptions{}
+	value = json.RawMessage(strings.Trim(string(value), " \t\r\n"))
+	switch {
+	case len(value) == 0 || string(value) == "null":
+	case value[0] == '"':
+		if err := json.Unmarshal(value, &opts.Target); err != nil {
+			return nil, err
+		}
+	case value[0] == '{':
+		dec := json.NewDecoder(strings.NewReader(string(value)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(opts); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("rule value must be a string or an object, got %s", value)
+	}
+	return opts, nil
+}
+
+// parseProxyProtocolVersion maps "v1"/"v2" to the version number, "off" to -1 and an empty setting to 0
+func parseProxyProtocolVersion(s string) (int, error) {
+	switch strings.ToLower(strings.Trim(s, " ")) {
+	case "":
+		return 0, nil
+	case "off", "none", "false":
+		return -1, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("invalid PROXY protocol version %q", s)
+}
+
+// normalizePattern is the form a pattern is stored in
+func normalizePattern(pattern string) string {
+	return strings.ToLower(strings.Trim(pattern, " "))
+}
+
+// Add parses and stores a pattern, the value is kept as is for GetJson
+func (m *RuleMap) Add(pattern string, value json.RawMessage) error {
+	pattern = normalizePattern(pattern)
+	rule, err := parseHostRule(pattern)
+	if err != nil {
+		return err
+	}
+	opts, err := parseRuleOptions(value)
+	if err != nil {
+		return fmt.Errorf("invalid value of %q, %v", pattern, err)
+	}
+	if rule.Target, err = parseRuleTarget(opts.Target); err != nil {
+		return err
+	}
+	if rule.ProxyProtocol, err = parseProxyProtocolVersion(opts.ProxyProtocol); err != nil {
+		return err
+	}
+	rule.ProxyProtocolAuthority = opts.ProxyProtocolAuthority
+	if rule.Via, err = parseUpstreamProxy(opts.Via); err != nil {
+		return err
+	}
+	if rule.Clients, err = parseCIDRACL(opts.AllowClients, opts.DenyClients); err != nil {
+		return fmt.Errorf("invalid client acl of %q, %v", pattern, err)
+	}
+	if rule.AllowDestinations, err = parseCIDRList(opts.AllowDestinations); err != nil {
+		return fmt.Errorf("invalid allow_destinations of %q, %v", pattern, err)
+	}
+	if !rule.Allow && *opts != (RuleOptions{}) {
+		return fmt.Errorf("exclusion %q can not have options", pattern)
+	}
+	var index map[string]*HostRule
+	switch rule.Kind {
+	case ruleExact:
+		index = m.exact
+	case ruleWildcard:
+		index = m.wildcard
+	default:
+		index = m.domain
+	}
+	// conflicting patterns for the same name, exclusion wins
+	if old, ok := index[rule.Name]; !ok || old.Allow {
+		index[rule.Name] = rule
+	}
+	m.entries[pattern] = value
+	return nil
+}
+
+// Match returns the rule deciding host, or nil when no pattern matches
+func (m *RuleMap) Match(host string) *HostRule {
+	if r, ok := m.exact[host]; ok {
+		return r
+	}
+	if r, ok := m.domain[host]; ok {
+		return r
+	}
+	for i := 0; i < len(host)-1; i++ {
+		if host[i] == '.' {
+			parent := host[i+1:]
+			d, hasDomain := m.domain[parent]
+			w, hasWildcard := m.wildcard[parent]
+			if hasDomain && hasWildcard {
+				if !w.Allow {
+					return w
+				}
+				return d
+			}
+			if hasDomain {
+				return d
+			}
+			if hasWildcard {
+				return w
+			}
+		}
+	}
+	return nil
+}
 
 type ForwardRules struct {
-	rules       [2]*BoolMap
+	rules       [2]*RuleMap
 	index       uint32
 	updateLock  sync.Mutex
 	cache       sync.Map
-	passThrough bool
+	passThrough uint32
 }
 
 func NewForwardRules() *ForwardRules {
 	ret := &ForwardRules{
-		rules:       [2]*BoolMap{},
+		rules:       [2]*RuleMap{NewRuleMap(), NewRuleMap()},
 		index:       0,
 		updateLock:  sync.Mutex{},
 		cache:       sync.Map{},
-		passThrough: false,
+		passThrough: 0,
 	}
 	if err := ret.Load(); err != nil {
 		logger.Fatalf("Load rules failed, err %v", err)
 		return nil
 	}
-	ret.passThrough = viper.GetBool("client.passthrough")
-
-	http.HandleFunc("/config/get", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write(ret.GetJson())
-	})
-	http.HandleFunc("/config/update", func(w http.ResponseWriter, r *http.Request) {
-		body, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		err := ret.PutJson(body)
-		if err != nil {
-			logger.Warnf("Unable to set host config, error %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("set hosts config error: %v", err)))
-		} else {
-			err := ret.Save()
-			if err != nil {
-				logger.Warn("save config failed, %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(fmt.Sprintf("save config error: %v", err)))
-			} else {
-				logger.Info("config updated and saved successfully")
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte("ok"))
-			}
-		}
-	})
+	ret.SetPassThrough(viper.GetBool("client.passthrough"))
 	return ret
 }
 
-func (f *ForwardRules) setRules(rules *BoolMap) {
+func (f *ForwardRules) setRules(rules *RuleMap) {
 	f.updateLock.Lock()
 	defer f.updateLock.Unlock()
 	var useIndex uint32
@@ -80,7 +278,7 @@ func (f *ForwardRules) setRules(rules *BoolMap) {
 
 	atomic.StoreUint32(&f.index, uint32(useIndex))
 
-	f.rules[oldindex] = &BoolMap{}
+	f.rules[oldindex] = NewRuleMap()
 
 	f.cache.Range(func(key interface{}, value interface{}) bool {
 		f.cache.Delete(key)
@@ -88,62 +286,142 @@ func (f *ForwardRules) setRules(rules *BoolMap) {
 	})
 }
 
-func (f *ForwardRules) IsHostAllowedByRule(host string) bool {
+// MatchHost returns the rule deciding host, nil if none matches
+func (f *ForwardRules) MatchHost(host string) *HostRule {
 	host = strings.Trim(strings.ToLower(host), ".")
 	if r, ok := f.cache.Load(host); ok {
-		return r.(bool)
+		metrics.RuleCache.Add(1, "hit")
+		return r.(*HostRule)
 	}
+	metrics.RuleCache.Add(1, "miss")
 	rules := f.rules[f.index]
-	if r, ok := (*rules)[host]; ok {
+	r := rules.Match(host)
+	// Negative cache is not necessary since DNS won't resolve to sniproxy
+	if r != nil {
 		f.cache.Store(host, r)
-		return r
 	}
-	hostlen := len(host)
-	// FIXME: this would fail if there is no '.' in the string, but it doesn't matter
-	for i := 0; i < hostlen-1; i++ {
-		if host[i] == '.' {
-			if r, ok := (*rules)[host[i+1:]]; ok {
-				f.cache.Store(host, r)
-				return r
-			}
+	return r
+}
+
+// RuleName returns the pattern of the rule deciding host, empty if none matches
+func (f *ForwardRules) RuleName(host string) string {
+	if r := f.MatchHost(host); r != nil {
+		return r.Pattern
+	}
+	return ""
+}
+
+func (f *ForwardRules) IsHostAllowedByRule(host string) bool {
+	r := f.MatchHost(host)
+	return r != nil && r.Allow
+}
+
+// Upstream returns the address to dial for a requested host, with or without port. It is the rule's target when the
+// matching rule has one, otherwise the host itself, defaultPort is used when neither carries a port.
+func (f *ForwardRules) Upstream(hostport string, defaultPort string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+		port = defaultPort
+	}
+	if r := f.MatchHost(host); r != nil && r.Allow && r.Target != "" {
+		if _, _, err := net.SplitHostPort(r.Target); err == nil {
+			return r.Target
 		}
+		host = r.Target
 	}
-	// Negative cache is not necessary since DNS won't resolve to sniproxy
-	return false
+	return net.JoinHostPort(host, port)
 }
 
-func (f *ForwardRules) GetJson() []byte {
-	rules := f.rules[f.index]
-	newmap := map[string]string{}
-	for k := range *rules {
-		newmap[k] = ""
+// hostOnly strips the port, if any, from a host header value
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// Via returns the upstream proxy to reach a requested host through, empty to connect directly
+func (f *ForwardRules) Via(hostport string) string {
+	if r := f.MatchHost(hostOnly(hostport)); r != nil && r.Allow && r.Via != "" {
+		if r.Via == upstreamDirect {
+			return ""
+		}
+		return r.Via
 	}
-	ret, _ := json.MarshalIndent(newmap, "", "  ")
+	return upstreamProxy
+}
+
+func (f *ForwardRules) GetJson() []byte {
+	ret, _ := json.MarshalIndent(f.Entries(), "", "  ")
 	return ret
 }
 
+// Entries returns a copy of the patterns and values of the rule set in use
+func (f *ForwardRules) Entries() map[string]json.RawMessage {
+	rules := f.rules[atomic.LoadUint32(&f.index)]
+	newmap := map[string]json.RawMessage{}
+	for k, v := range rules.entries {
+		newmap[k] = v
+	}
+	return newmap
+}
+
 func (f *ForwardRules) PutJson(data []byte) error {
-	var test map[string]string
+	rules, err := parseRuleMap(data)
+	if err != nil {
+		return err
+	}
+	f.setRules(rules)
+	return nil
+}
+
+func parseRuleMap(data []byte) (*RuleMap, error) {
+	var test map[string]json.RawMessage
 	if err := json.Unmarshal(data, &test); err != nil {
 		logger.Warnf("Unable to parse json, error %v", err)
-		return err
+		return nil, err
 	}
-	rules := BoolMap{}
-	for k := range test {
-		k = strings.ToLower(k)
-		rules[k] = true
+	return buildRuleMap(test)
+}
+
+// buildRuleMap parses patterns and their values
+func buildRuleMap(entries map[string]json.RawMessage) (*RuleMap, error) {
+	rules := NewRuleMap()
+	for k, v := range entries {
+		if err := rules.Add(k, v); err != nil {
+			logger.Warnf("Unable to parse rule, error %v", err)
+			return nil, err
+		}
 	}
-	f.setRules(&rules)
-	return nil
+	return rules, nil
+}
+
+// SetPassThrough allows or rejects hosts matching no rule at all
+func (f *ForwardRules) SetPassThrough(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&f.passThrough, v)
 }
 
+func (f *ForwardRules) PassThrough() bool {
+	return atomic.LoadUint32(&f.passThrough) != 0
+}
+
+// IsHostAllowed applies the rules, hosts matching no pattern at all are only allowed in passthrough mode. A port is
+// ignored, it must not get a host around its exclusion.
 func (f *ForwardRules) IsHostAllowed(remoteHost string) bool {
-	return f.passThrough || f.IsHostAllowedByRule(remoteHost)
+	if r := f.MatchHost(hostOnly(remoteHost)); r != nil {
+		return r.Allow
+	}
+	return f.PassThrough()
 }
 
 func (f *ForwardRules) RunConnection(clientConn *tlsConn, remoteHost string, pendingMessage *tlsMessage) error {
 	defer clientConn.conn.Close()
-	if !f.passThrough && !f.IsHostAllowedByRule(remoteHost) {
+	if !f.PassThrough() && !f.IsHostAllowedByRule(remoteHost) {
 		return errTargetRejected
 	}
 	if _, _, err := net.SplitHostPort(remoteHost); err != nil {
@@ -169,22 +447,37 @@ func (f *ForwardRules) RunConnection(clientConn *tlsConn, remoteHost string, pen
 	return clientConn.copyConn(serverConn)
 }
 
+// Load reads the rules file at startup, a backup is used if the file is unusable
 func (f *ForwardRules) Load() error {
-	fn := GetFileLocation(viper.GetString("client.rules"))
-	if fn != "" {
-		data, err := ioutil.ReadFile(fn)
-		if err != nil {
-			return err
-		}
-		return f.PutJson(data)
+	rules, err := loadRuleFile(viper.GetString("client.rules"))
+	if err != nil || rules == nil {
+		return err
 	}
+	f.setRules(rules)
 	return nil
 }
 
+// readRuleFile parses a rules file, nil without error when no file is configured
+func readRuleFile(name string) (*RuleMap, error) {
+	fn := GetFileLocation(name)
+	if fn == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleMap(data)
+}
+
+// Save replaces the rules file atomically, keeping client.rulesbackups backups of the previous versions
 func (f *ForwardRules) Save() error {
-	fn := GetFileLocation(viper.GetString("client.rules"))
+	// called from the console, a reload may be replacing the settings meanwhile
+	configLock.RLock()
+	fn, keep := GetFileLocation(viper.GetString("client.rules")), viper.GetInt("client.rulesbackups")
+	configLock.RUnlock()
 	if fn != "" {
-		return ioutil.WriteFile(fn, f.GetJson(), 0655)
+		return saveRuleFile(fn, f.GetJson(), keep)
 	}
 	return nil
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testRules = `{
+  "yuanshen.com": "",
+  "!api.yuanshen.com": null,
+  "=static.yuanshen.com": "10.0.0.5:8080",
+  "example.com": "origin.example.net",
+  "!*.example.com": null,
+  "=mail.example.com": "",
+  "download.example.com": "",
+  "*.cdn.example.com": "",
+  "!*.cdn.example.com": null
+}`
+
+// testForwardRules returns forward rules holding the patterns of a hosts.json
+func testForwardRules(t *testing.T, data string) *ForwardRules {
+	rules, err := parseRuleMap([]byte(data))
+	if err != nil {
+		t.Fatalf("parseRuleMap err %v", err)
+	}
+	f := &ForwardRules{rules: [2]*RuleMap{NewRuleMap(), NewRuleMap()}}
+	f.setRules(rules)
+	return f
+}
+
+func TestRuleMapMatch(t *testing.T) {
+	m, err := parseRuleMap([]byte(testRules))
+	if err != nil {
+		t.Fatalf("parseRuleMap err %v", err)
+	}
+	tests := []struct {
+		host    string
+		pattern string
+	}{
+		{"yuanshen.com", "yuanshen.com"},
+		{"www.yuanshen.com", "yuanshen.com"},
+		// the longest matching domain decides
+		{"api.yuanshen.com", "!api.yuanshen.com"},
+		{"v2.api.yuanshen.com", "!api.yuanshen.com"},
+		// an exact pattern decides first, but only for the host itself
+		{"static.yuanshen.com", "=static.yuanshen.com"},
+		{"img.static.yuanshen.com", "yuanshen.com"},
+		// a wildcard doesn't match the domain it names
+		{"example.com", "example.com"},
+		// a wildcard exclusion beats the domain at the same level
+		{"www.example.com", "!*.example.com"},
+		{"cdn.example.com", "!*.example.com"},
+		{"mail.example.com", "=mail.example.com"},
+		{"download.example.com", "download.example.com"},
+		{"a.download.example.com", "download.example.com"},
+		// conflicting patterns for the same name, the exclusion wins
+		{"x.cdn.example.com", "!*.cdn.example.com"},
+		{"notyuanshen.com", ""},
+		{"yuanshen.com.example.net", ""},
+		{"com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		pattern := ""
+		if r := m.Match(tt.host); r != nil {
+			pattern = r.Pattern
+		}
+		if pattern != tt.pattern {
+			t.Errorf("Match(%q) = %q, want %q", tt.host, pattern, tt.pattern)
+		}
+	}
+}
+
+func TestRuleMapAdd(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		ok      bool
+	}{
+		{"example.com", `""`, true},
+		{"Example.COM.", `null`, true},
+		{"example.com", `"[2001:db8::1]:443"`, true},
+		{"example.com", `{"target": "10.0.0.5", "proxy_protocol": "v2", "via": "direct"}`, true},
+		{"example.com", `{"allow_clients": "10.0.0.0/8", "deny_clients": "10.0.0.1"}`, true},
+		{"", `""`, false},
+		{"!", `""`, false},
+		{"*.", `""`, false},
+		{"*.*.example.com", `""`, false},
+		{"example.com:443", `""`, false},
+		{"exa mple.com", `""`, false},
+		{"example.com", `"10.0.0.5:65536"`, false},
+		{"example.com", `"http://10.0.0.5/"`, false},
+		{"example.com", `5`, false},
+		{"example.com", `{"target": "10.0.0.5", "unknown": 1}`, false},
+		{"example.com", `{"proxy_protocol": "v3"}`, false},
+		{"example.com", `{"allow_clients": "10.0.0.0/33"}`, false},
+		{"example.com", `{"allow_destinations": "private"}`, false},
+		{"!example.com", `"10.0.0.5"`, false},
+	}
+	for _, tt := range tests {
+		err := NewRuleMap().Add(tt.pattern, json.RawMessage(tt.value))
+		if (err == nil) != tt.ok {
+			t.Errorf("Add(%q, %s) err %v, want ok %v", tt.pattern, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestIsHostAllowed(t *testing.T) {
+	f := testForwardRules(t, testRules)
+	tests := []struct {
+		host        string
+		allowed     bool
+		passThrough bool // allowed in passthrough mode
+	}{
+		{"www.yuanshen.com", true, true},
+		{"www.yuanshen.com:8080", true, true},
+		{"WWW.Yuanshen.com.", true, true},
+		{"api.yuanshen.com", false, false},
+		// a port must not get around an exclusion
+		{"api.yuanshen.com:80", false, false},
+		{"API.yuanshen.com.:443", false, false},
+		{"www.example.com:80", false, false},
+		{"unknown.example.net", false, true},
+		{"unknown.example.net:443", false, true},
+		{"192.0.2.1:80", false, true},
+		{"[2001:db8::1]:80", false, true},
+	}
+	for _, tt := range tests {
+		for _, passThrough := range []bool{false, true} {
+			f.SetPassThrough(passThrough)
+			want := tt.allowed
+			if passThrough {
+				want = tt.passThrough
+			}
+			if got := f.IsHostAllowed(tt.host); got != want {
+				t.Errorf("passthrough %v: IsHostAllowed(%q) = %v, want %v", passThrough, tt.host, got, want)
+			}
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	f := testForwardRules(t, testRules)
+	tests := []struct {
+		hostport    string
+		defaultPort string
+		want        string
+	}{
+		{"www.yuanshen.com", "80", "www.yuanshen.com:80"},
+		{"www.yuanshen.com:8080", "80", "www.yuanshen.com:8080"},
+		// a target with a port replaces both
+		{"static.yuanshen.com", "443", "10.0.0.5:8080"},
+		{"static.yuanshen.com:80", "443", "10.0.0.5:8080"},
+		// a target without keeps the port of the request
+		{"example.com", "443", "origin.example.net:443"},
+		{"example.com:8443", "80", "origin.example.net:8443"},
+		// exclusions have no target
+		{"www.example.com:80", "443", "www.example.com:80"},
+		{"unknown.example.net", "80", "unknown.example.net:80"},
+		{"[2001:db8::1]:8443", "80", "[2001:db8::1]:8443"},
+		{"2001:db8::1", "80", "[2001:db8::1]:80"},
+	}
+	for _, tt := range tests {
+		if got := f.Upstream(tt.hostport, tt.defaultPort); got != tt.want {
+			t.Errorf("Upstream(%q, %q) = %q, want %q", tt.hostport, tt.defaultPort, got, tt.want)
+		}
+	}
+}
@@ -1,32 +1,64 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
-	"time"
+	"strconv"
+	"sync/atomic"
 )
 
 type HTTPProxy struct {
 	proxy  httputil.ReverseProxy
 	rules  *ForwardRules
 	listen string
+	server *http.Server
+}
+
+// upstreamTransport is shared by all http listeners, and by the download cache when enabled
+var upstreamTransport = &viaTransport{
+	transports: map[string]*http.Transport{},
 }
 
 func NewHTTPProxy(r *ForwardRules, listen string) *HTTPProxy {
+	var transport http.RoundTripper = upstreamTransport
+	if downloadCache != nil {
+		transport = downloadCache
+	}
 	return &HTTPProxy{
 		proxy: httputil.ReverseProxy{
 			Director: func(h *http.Request) {
 				h.URL.Scheme = "http"
-				h.URL.Host = h.Host
+				// Host header is kept, only the dialed address follows the rule's target
+				h.URL.Host = r.Upstream(h.Host, "80")
+				loopDetector.AddHopMarker(h.Header)
 			},
-			Transport: &http.Transport{
-				MaxIdleConns:          100,
-				MaxIdleConnsPerHost:   100,
-				MaxConnsPerHost:       0,
-				IdleConnTimeout:       time.Second * 30,
-				ResponseHeaderTimeout: time.Second * 15,
-				ExpectContinueTimeout: time.Second * 15,
-				Dial:                  dialer.Dial,
+			Transport: transport,
+			ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+				logger.Infow("http proxy fail", "host", r.Host, "err", err)
+				if rec := accessRecord(r.Context()); rec != nil {
+					if errors.Is(err, errDestinationBlocked) {
+						rec.Fail(accessResultRejected, err)
+					} else if rec.Upstream() == "" {
+						// no connection was handed out when the dial failed
+						rec.Fail(accessResultDialFailed, err)
+					} else {
+						rec.Fail(accessResultUpstreamReset, err)
+					}
+				}
+				if errors.Is(err, errForwardLoop) {
+					rw.WriteHeader(http.StatusLoopDetected)
+					return
+				}
+				if errors.Is(err, errDestinationBlocked) {
+					rw.WriteHeader(http.StatusForbidden)
+					return
+				}
+				rw.WriteHeader(http.StatusBadGateway)
 			},
 		},
 		rules:  r,
@@ -35,20 +67,118 @@ func NewHTTPProxy(r *ForwardRules, listen string) *HTTPProxy {
 }
 func (c *HTTPProxy) Start() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
-		if !c.rules.IsHostAllowed(r.Host) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		rec := NewAccessRecord("http", c.listen, r.RemoteAddr)
+		rec.Method, rec.Path, rec.Proto = r.Method, r.RequestURI, r.Proto
+		rec.Referer, rec.UserAgent = r.Referer(), r.UserAgent()
+		rec.SetHost(r.Host)
+		rec.SetRule(c.rules.RuleName(hostOnly(r.Host)))
+		up, down := metrics.TrafficCounters(rec.Rule(), hostOnly(r.Host))
+		rw := &metricsResponseWriter{ResponseWriter: w, counter: down}
+		body := &countingBody{ReadCloser: http.NoBody, counter: up}
+		if r.Body != nil {
+			body.ReadCloser = r.Body
+			r.Body = body
+		}
+		defer func() {
+			// ReverseProxy aborts the handler with a panic when copying the body breaks off, which is the upstream's
+			// fault unless the client went away
+			v := recover()
+			if v != nil && r.Context().Err() == nil {
+				rec.Fail(accessResultUpstreamReset, fmt.Errorf("%v", v))
+			}
+			metrics.HTTPResponses.Add(1, strconv.Itoa(rw.status))
+			rec.Status, rec.BytesUp, rec.BytesDown = rw.status, atomic.LoadInt64(&body.total), atomic.LoadInt64(&rw.written)
+			LogAccess(rec)
+			if v != nil {
+				panic(v)
+			}
+		}()
+		clientIP := net.ParseIP(hostOnly(r.RemoteAddr))
+		if !clientAllowed(rec, clientIP) {
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte("Forbidden"))
+			return
+		}
+		if !c.rules.IsHostAllowed(hostOnly(r.Host)) {
+			metrics.ConnectionErrors.Add(1, "http", errorReason(errTargetRejected))
+			rec.Fail(accessResultRejected, errTargetRejected)
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte("Forbidden"))
+			return
+		}
+		if !clientAllowedByRule(rec, clientIP, c.rules.MatchHost(hostOnly(r.Host))) {
 			rw.WriteHeader(http.StatusForbidden)
 			rw.Write([]byte("Forbidden"))
 			return
 		}
-		LogAccess("http", r.RemoteAddr, r.Host)
-		c.proxy.ServeHTTP(rw, r)
+		if loopDetector.HasHopMarker(r.Header) {
+			metrics.ConnectionErrors.Add(1, "http", errorReason(errForwardLoop))
+			logger.Warnw("forwarding loop detected", "from", r.RemoteAddr, "host", r.Host)
+			rec.Fail(accessResultRejected, errForwardLoop)
+			rw.WriteHeader(http.StatusLoopDetected)
+			rw.Write([]byte("Loop Detected"))
+			return
+		}
+		ctx := withUpstreamVia(withAccessRecord(r.Context(), rec), c.rules.Via(r.Host))
+		ctx, cancel := context.WithCancel(withUpstreamRule(ctx, c.rules.MatchHost(hostOnly(r.Host))))
+		defer cancel()
+		live := connections.Add(rec)
+		defer connections.Remove(live)
+		live.Track(cancel, func() int64 {
+			return atomic.LoadInt64(&body.total)
+		}, func() int64 {
+			return atomic.LoadInt64(&rw.written)
+		})
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				rec.SetUpstream(info.Conn.RemoteAddr().String())
+			},
+		})
+		c.proxy.ServeHTTP(rw, r.WithContext(ctx))
 	})
+	l, err := listenTCP(c.listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen %s, %w", c.listen, err)
+	}
+	if proxyProtocolEnabled("http", c.listen) {
+		pl, err := NewProxyProtocolListener(l)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("unable to enable PROXY protocol on %s, %w", c.listen, err)
+		}
+		l = pl
+	}
 	logger.Infof("Initialize ok, start serving http at %v", c.listen)
+	c.server = &http.Server{
+		Handler: mux,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				metrics.ConnectionsTotal.Add(1, c.listen, "http")
+				metrics.ConnectionsActive.Add(1, c.listen, "http")
+			case http.StateHijacked, http.StateClosed:
+				metrics.ConnectionsActive.Add(-1, c.listen, "http")
+			}
+		},
+	}
 	go func() {
-		if err := http.ListenAndServe(c.listen, mux); err != nil {
+		if err := c.server.Serve(l); err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Start http server failed, err:", err)
 		}
 	}()
 	return nil
 }
+
+// Stop closes the listener and waits for the requests in progress to finish, those still running when ctx is done
+// are aborted
+func (c *HTTPProxy) Stop(ctx context.Context) error {
+	err := c.server.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	n := connections.KillListener("http", c.listen)
+	logger.Warnf("Aborted %d http requests on %s still running after draining", n, c.listen)
+	c.server.Close()
+	return err
+}
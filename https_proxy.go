@@ -1,92 +1,219 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
 )
 
 type HTTPSProxy struct {
-	rules  *ForwardRules
-	listen string
+	rules                  *ForwardRules
+	listen                 string
+	proxyProtocol          int
+	proxyProtocolAuthority bool
+	listener               net.Listener
+	closing                int32
+	active                 sync.WaitGroup
 }
 
 func NewHTTPSProxy(r *ForwardRules, listen string) *HTTPSProxy {
+	version, err := parseProxyProtocolVersion(viper.GetString("upstream.proxyprotocol"))
+	if err != nil {
+		logger.Fatalf("Invalid upstream.proxyprotocol, err %v", err)
+		return nil
+	}
 	return &HTTPSProxy{
-		rules:  r,
-		listen: listen,
+		rules:                  r,
+		listen:                 listen,
+		proxyProtocol:          version,
+		proxyProtocolAuthority: viper.GetBool("upstream.proxyprotocolauthority"),
+	}
+}
+
+// proxyProtocolHeader returns the PROXY protocol header to send upstream for a client connection, nil if none
+func (c *HTTPSProxy) proxyProtocolHeader(client net.Conn, serverName string) []byte {
+	version, authority := c.proxyProtocol, c.proxyProtocolAuthority
+	if r := c.rules.MatchHost(serverName); r != nil {
+		if r.ProxyProtocol != 0 {
+			version = r.ProxyProtocol
+		}
+		authority = authority || r.ProxyProtocolAuthority
+	}
+	if version <= 0 {
+		return nil
 	}
+	if !authority {
+		serverName = ""
+	}
+	return buildProxyProtocolHeader(version, client.RemoteAddr(), client.LocalAddr(), serverName)
 }
 
-func (c *HTTPSProxy) RunConnection(HTTPSProxyConn *tlsConn, remoteHost string, pendingMessage *tlsMessage) error {
+func (c *HTTPSProxy) RunConnection(HTTPSProxyConn *tlsConn, serverName string, remoteHost string, pendingMessage *tlsMessage, live *liveConnection) error {
 	defer HTTPSProxyConn.conn.Close()
+	rec := live.rec
 	if _, _, err := net.SplitHostPort(remoteHost); err != nil {
 		remoteHost = net.JoinHostPort(remoteHost, "443")
 	}
-	conn, err := dialer.Dial("tcp", remoteHost)
+	ctx := withUpstreamRule(context.Background(), c.rules.MatchHost(serverName))
+	conn, err := dialVia(ctx, c.rules.Via(serverName), "tcp", remoteHost)
+	if errors.Is(err, errDestinationBlocked) {
+		rec.Fail(accessResultRejected, err)
+		return err
+	}
 	if err != nil {
 		logger.Infow("remote connect fail", "remote", remoteHost, "err", err)
+		rec.Fail(accessResultDialFailed, err)
 		return err
 	}
 	defer conn.Close()
+	rec.SetUpstream(conn.RemoteAddr().String())
+	_, down := metrics.TrafficCounters(rec.Rule(), serverName)
+	counted := &countingConn{Conn: conn, counter: down}
+	live.Track(func() { conn.Close() }, nil, counted.Total)
+	defer func() {
+		rec.BytesDown = counted.Total()
+	}()
+	if header := c.proxyProtocolHeader(HTTPSProxyConn.conn, serverName); header != nil {
+		if _, err := conn.Write(header); err != nil {
+			logger.Infof("write PROXY protocol header to %s failed in RunConnection", conn.RemoteAddr())
+			rec.Fail(accessResultUpstreamReset, err)
+			return err
+		}
+	}
 	serverConn := &tlsConn{
-		conn:          conn,
+		conn:          counted,
 		readBuffer:    []byte{},
 		versionBuffer: []byte{},
 	}
 
 	if err := serverConn.WriteMessage(pendingMessage); err != nil {
 		logger.Infof("write pending message to %s failed in RunConnection", serverConn.conn.RemoteAddr())
+		rec.Fail(accessResultUpstreamReset, err)
 		return err
 	}
 	go serverConn.copyConn(HTTPSProxyConn)
-	return HTTPSProxyConn.copyConn(serverConn)
+	err = HTTPSProxyConn.copyConn(serverConn)
+	if counted.readErr != nil {
+		rec.Fail(accessResultUpstreamReset, counted.readErr)
+	}
+	return err
 }
 
 func (c *HTTPSProxy) Serve(conn net.Conn) error {
+	counted := &countingConn{Conn: conn}
+	rec := NewAccessRecord("https", c.listen, conn.RemoteAddr().String())
+	defer func() {
+		rec.BytesUp = counted.Total()
+		LogAccess(rec)
+	}()
 	defer conn.Close()
+	live := connections.Add(rec)
+	defer connections.Remove(live)
+	live.Track(func() { conn.Close() }, counted.Total, nil)
+	metrics.ConnectionsTotal.Add(1, c.listen, "https")
+	metrics.ConnectionsActive.Add(1, c.listen, "https")
+	defer metrics.ConnectionsActive.Add(-1, c.listen, "https")
 	clientConn := &tlsConn{
-		conn:          conn,
+		conn:          counted,
 		readBuffer:    []byte{},
 		versionBuffer: []byte{},
 	}
+	fail := func(result string, err error) error {
+		metrics.ConnectionErrors.Add(1, "https", errorReason(err))
+		rec.Fail(result, err)
+		return err
+	}
+	clientIP := addrIP(conn.RemoteAddr())
+	if !clientAllowed(rec, clientIP) {
+		return errClientDenied
+	}
 	p, err := clientConn.ReadMessage()
 	if err != nil {
 		logger.Warnf("Read HTTPSProxyhello from %s failed, error %v, exiting", conn.RemoteAddr().String(), err)
-		return err
+		return fail(accessResultTLSParseError, err)
 	}
 	logger.Debugf("Got a packet %v, %d", p.IsHandShake, p.Type())
 	if p.IsHandShake && p.Type() == tlsTypeMessageClientHello {
 		serverName, err := p.ExtractSNI()
 		if err != nil {
-			return err
+			return fail(accessResultTLSParseError, err)
 		}
+		rec.SetHost(serverName)
 		if !c.rules.IsHostAllowed(serverName) {
-			return errTargetRejected
+			return fail(accessResultRejected, errTargetRejected)
 		}
-		LogAccess("https", conn.RemoteAddr().String(), serverName)
-		return c.RunConnection(clientConn, serverName, p)
+		if !clientAllowedByRule(rec, clientIP, c.rules.MatchHost(serverName)) {
+			return errClientDenied
+		}
+		rec.SetRule(c.rules.RuleName(serverName))
+		up, _ := metrics.TrafficCounters(rec.Rule(), serverName)
+		counted.SetCounter(up)
+		return c.RunConnection(clientConn, serverName, c.rules.Upstream(serverName, "443"), p, live)
 	}
 	logger.Warnf("Non Clienthello packet from %s", conn.RemoteAddr().String())
-	return errInvalidTLSProtocol
+	return fail(accessResultTLSParseError, errInvalidTLSProtocol)
 }
 
 func (c *HTTPSProxy) Start() error {
-	l, err := net.Listen("tcp", c.listen)
+	l, err := listenTCP(c.listen)
 	if err != nil {
-		logger.Fatalf("Unable to listen %s, %v", c.listen, err)
-		return err
+		return fmt.Errorf("unable to listen %s, %w", c.listen, err)
 	}
+	if proxyProtocolEnabled("https", c.listen) {
+		pl, err := NewProxyProtocolListener(l)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("unable to enable PROXY protocol on %s, %w", c.listen, err)
+		}
+		l = pl
+	}
+	c.listener = l
 	logger.Infof("Initialize ok, start serving https at %v", c.listen)
 	go func() {
 		defer l.Close()
 		for {
 			conn, err := l.Accept()
 			if err != nil {
+				if atomic.LoadInt32(&c.closing) != 0 {
+					return
+				}
 				logger.Warnf("Error when accepting, error %v", err)
 				continue
 			}
-			logger.Debugf("Received connection from %s", conn.RemoteAddr().String())
-			go c.Serve(conn)
+			c.active.Add(1)
+			go func() {
+				defer c.active.Done()
+				// behind PROXY protocol RemoteAddr reads the header, keep it out of the accept loop
+				logger.Debugf("Received connection from %s", conn.RemoteAddr().String())
+				c.Serve(conn)
+			}()
 		}
 	}()
 	return nil
 }
+
+// Stop closes the listener and waits for the open connections to finish, those still open when ctx is done are
+// closed
+func (c *HTTPSProxy) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&c.closing, 1)
+	c.listener.Close()
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	n := connections.KillListener("https", c.listen)
+	logger.Warnf("Closed %d https connections on %s still open after draining", n, c.listen)
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// set for a child started by upgrade: the number of listening sockets passed from fd 3 on, followed by the
+	// descriptor the child reports readiness on
+	envListenFDs = "RPROXY_LISTEN_FDS"
+	// systemd socket activation
+	envSystemdListenFDs = "LISTEN_FDS"
+	envSystemdListenPID = "LISTEN_PID"
+	envSystemdFDNames   = "LISTEN_FDNAMES"
+
+	listenFDsStart     = 3
+	upgradeTimeout     = 30 * time.Second
+	consoleStopTimeout = 10 * time.Second
+)
+
+var (
+	listenersLock sync.Mutex
+	// sockets received from the parent or systemd, not claimed by a listen address yet
+	inherited []interface{}
+	// every socket opened or inherited, handed to the child on upgrade
+	activeSockets []interface{}
+	// the child of an upgrade writes here once it is serving
+	upgradeReady *os.File
+)
+
+// inheritListeners picks up the listening sockets passed by a parent rproxy or by systemd socket activation
+func inheritListeners() {
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	fromParent := err == nil
+	if !fromParent {
+		n, err = strconv.Atoi(os.Getenv(envSystemdListenFDs))
+		if err != nil || os.Getenv(envSystemdListenPID) != strconv.Itoa(os.Getpid()) {
+			return
+		}
+	}
+	// not for the processes we start ourselves
+	for _, k := range []string{envListenFDs, envSystemdListenFDs, envSystemdListenPID, envSystemdFDNames} {
+		os.Unsetenv(k)
+	}
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFDsStart+i), "listener")
+		if l, err := net.FileListener(f); err == nil {
+			inherited = append(inherited, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			inherited = append(inherited, pc)
+		} else {
+			logger.Warnf("Ignoring inherited file descriptor %d, err %v", listenFDsStart+i, err)
+		}
+		f.Close()
+	}
+	if fromParent {
+		upgradeReady = os.NewFile(uintptr(listenFDsStart+n), "upgrade-ready")
+	}
+	logger.Infof("Inherited %d listening sockets", len(inherited))
+}
+
+// sameAddr tells whether a socket bound to actual serves the listen address configured as listen
+func sameAddr(network, listen string, actual net.Addr) bool {
+	var ip net.IP
+	var port int
+	switch a := actual.(type) {
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		if network != "udp" {
+			return false
+		}
+		ip, port = a.IP, a.Port
+	default:
+		return false
+	}
+	host, p, err := net.SplitHostPort(listen)
+	if err != nil || strconv.Itoa(port) != p {
+		return false
+	}
+	want := net.ParseIP(host)
+	if host == "" || (want != nil && want.IsUnspecified()) {
+		return ip.IsUnspecified()
+	}
+	if want == nil {
+		// a host name, compare with what it resolves to
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if a.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return want.Equal(ip)
+}
+
+// listenTCP returns the inherited socket for listen if there is one, otherwise it binds a new one
+func listenTCP(listen string) (net.Listener, error) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	for i, s := range inherited {
+		if l, ok := s.(net.Listener); ok && sameAddr("tcp", listen, l.Addr()) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			activeSockets = append(activeSockets, l)
+			return l, nil
+		}
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	activeSockets = append(activeSockets, l)
+	return l, nil
+}
+
+// listenUDP is listenTCP for packet sockets
+func listenUDP(listen string) (net.PacketConn, error) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	for i, s := range inherited {
+		if pc, ok := s.(net.PacketConn); ok && sameAddr("udp", listen, pc.LocalAddr()) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			activeSockets = append(activeSockets, pc)
+			return pc, nil
+		}
+	}
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	activeSockets = append(activeSockets, pc)
+	return pc, nil
+}
+
+// listenersReady closes the inherited sockets no listen address asked for, and tells the parent of an upgrade that
+// it may go away
+func listenersReady() {
+	listenersLock.Lock()
+	for _, s := range inherited {
+		switch s := s.(type) {
+		case net.Listener:
+			logger.Infof("Closing unused inherited socket %v", s.Addr())
+			s.Close()
+		case net.PacketConn:
+			logger.Infof("Closing unused inherited socket %v", s.LocalAddr())
+			s.Close()
+		}
+	}
+	inherited = nil
+	listenersLock.Unlock()
+	if upgradeReady != nil {
+		upgradeReady.Write([]byte{1})
+		upgradeReady.Close()
+		upgradeReady = nil
+	}
+}
+
+// upgrade starts a new rproxy from the current executable, handing it all listening sockets, and returns once the
+// new process is serving. The caller then drains and exits.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listenersLock.Lock()
+	files := []*os.File{}
+	open := []interface{}{}
+	for _, s := range activeSockets {
+		var f *os.File
+		switch s := s.(type) {
+		case *net.TCPListener:
+			f, err = s.File()
+		case *net.UDPConn:
+			f, err = s.File()
+		default:
+			err = fmt.Errorf("unsupported socket %T", s)
+		}
+		if errors.Is(err, net.ErrClosed) {
+			// the listener was removed by a config reload
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		files = append(files, f)
+		open = append(open, s)
+	}
+	if err == nil {
+		activeSockets = open
+	}
+	listenersLock.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envListenFDs+"="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Started new process %d with %d listening sockets", cmd.Process.Pid, len(files))
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := readyReader.Read(b)
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if ok {
+			return nil
+		}
+		return fmt.Errorf("new process %d failed to start, exit %v", cmd.Process.Pid, <-exited)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready after %v", cmd.Process.Pid, upgradeTimeout)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const localAddrRefreshInterval = 30 * time.Second
+
+var (
+	loopDetector *LoopDetector
+)
+
+// LoopDetector tells whether an upstream address is actually one of rproxy's own listeners, which happens when the
+// target name resolves back to the proxy. Dialing it would recurse until file descriptors run out.
+type LoopDetector struct {
+	listens   []*net.TCPAddr
+	localIPs  []net.IP
+	refreshed time.Time
+	lock      sync.Mutex
+	hopHeader string
+	hopID     string
+}
+
+func NewLoopDetector() *LoopDetector {
+	ret := &LoopDetector{
+		listens:   []*net.TCPAddr{},
+		localIPs:  []net.IP{},
+		lock:      sync.Mutex{},
+		hopHeader: viper.GetString("http.hopheader"),
+	}
+	ret.SetListens(proxyListens(viper.GetViper()))
+	id := make([]byte, 8)
+	rand.Read(id)
+	ret.hopID = hex.EncodeToString(id)
+	return ret
+}
+
+// proxyListens lists the https and http listen addresses of a configuration
+func proxyListens(v *viper.Viper) []string {
+	ret := []string{}
+	for _, s := range strings.Split(v.GetString("https.listen")+","+v.GetString("http.listen"), ",") {
+		if s = strings.Trim(s, " "); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// SetListens replaces the listen addresses to protect, when listeners are added or removed on reload
+func (l *LoopDetector) SetListens(listens []string) {
+	addrs := []*net.TCPAddr{}
+	for _, s := range listens {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			logger.Warnf("Unable to resolve listen address %s for loop detection, err %v", s, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	l.lock.Lock()
+	l.listens = addrs
+	l.lock.Unlock()
+}
+
+func (l *LoopDetector) isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if time.Since(l.refreshed) > localAddrRefreshInterval {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			logger.Warnf("Unable to get local interface addresses, err %v", err)
+		} else {
+			l.localIPs = []net.IP{}
+			for _, a := range addrs {
+				if n, ok := a.(*net.IPNet); ok {
+					l.localIPs = append(l.localIPs, n.IP)
+				}
+			}
+			l.refreshed = time.Now()
+		}
+	}
+	for _, local := range l.localIPs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLoop reports whether connecting to ip:port would reach one of our own https or http listeners
+func (l *LoopDetector) IsLoop(ip net.IP, port int) bool {
+	l.lock.Lock()
+	listens := l.listens
+	l.lock.Unlock()
+	for _, listen := range listens {
+		if listen.Port != port {
+			continue
+		}
+		if listen.IP == nil || listen.IP.IsUnspecified() {
+			if l.isLocalIP(ip) {
+				return true
+			}
+		} else if listen.IP.Equal(ip) || ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasHopMarker reports whether an http request has already passed through this very instance
+func (l *LoopDetector) HasHopMarker(h http.Header) bool {
+	if l.hopHeader == "" {
+		return false
+	}
+	for _, v := range h.Values(l.hopHeader) {
+		for _, id := range strings.Split(v, ",") {
+			if strings.Trim(id, " ") == l.hopID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddHopMarker tags an outgoing http request with this instance's id
+func (l *LoopDetector) AddHopMarker(h http.Header) {
+	if l.hopHeader != "" {
+		h.Add(l.hopHeader, l.hopID)
+	}
+}
@@ -1,55 +1,138 @@
 package main
 
 import (
-	"net"
-	"strings"
-	"time"
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/spf13/viper"
 )
 
-var (
-	dialer net.Dialer
-)
+// proxyServer is a listener that can be drained on shutdown
+type proxyServer interface {
+	Start() error
+	Stop(ctx context.Context) error
+}
 
 func main() {
 	setupConfig()
 	setupLog()
-	startDefaultHTTPServer()
+	inheritListeners()
+	accessLog = NewAccessLog()
+	metrics = NewMetrics()
+	connections = NewConnectionRegistry()
+	console := startDefaultHTTPServer()
 	rules := NewForwardRules()
-	dialer = net.Dialer{}
-	if viper.GetString("global.outip") != "" {
-		ip := net.ParseIP(viper.GetString("global.outip"))
-		if ip == nil {
-			logger.Fatalf("Invalid outgoing IP %s specified", viper.GetString("global.outip"))
-			return
-		}
-		dialer.LocalAddr = &net.TCPAddr{
-			IP:   ip,
-			Port: 0,
-			Zone: "",
-		}
+	rulesAPI = NewRulesAPI(rules)
+	d, err := newDialer(viper.GetString("global.outip"))
+	if err != nil {
+		logger.Fatalf("Invalid global.outip, err %v", err)
+		return
 	}
-	dialer.Timeout = time.Second * 15
-
-	hasSomethingToDo := false
-	for _, s := range strings.Split(viper.GetString("https.listen"), ",") {
-		s = strings.Trim(s, " ")
-		NewHTTPSProxy(rules, s).Start()
-		hasSomethingToDo = true
+	upstreamDialer.Store(d)
+	acl, err := newClientACL(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("Unable to set up client acls, err %v", err)
+		return
+	}
+	clientACL.Store(acl)
+	policy, err := newDestinationPolicy(viper.GetViper())
+	if err != nil {
+		logger.Fatalf("Unable to set up the destination policy, err %v", err)
+		return
 	}
-	for _, s := range strings.Split(viper.GetString("http.listen"), ",") {
-		s = strings.Trim(s, " ")
-		NewHTTPProxy(rules, s).Start()
-		hasSomethingToDo = true
+	destinationPolicy.Store(policy)
+	setupUpstreamProxy()
+	resolver = NewResolver()
+	loopDetector = NewLoopDetector()
+	if viper.GetString("cache.dir") != "" {
+		downloadCache = NewDownloadCache(upstreamTransport, rules)
 	}
 
-	if !hasSomethingToDo {
+	servers := newServerSet(rules)
+	if _, err := servers.Update(); err != nil {
+		logger.Fatalf("Unable to start, err %v", err)
+		return
+	}
+	if len(servers.All()) == 0 {
 		logger.Errorf("Neither http nor https server configured, quitting...")
 		return
 	}
-	// sleep forever
+	listenersReady()
+	reloader := newConfigReloader(servers, rules)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
 	for {
-		time.Sleep(time.Duration(1<<63 - 1))
+		select {
+		case <-reloader.changed:
+			reload(reloader, "config file changed")
+			continue
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				reload(reloader, "SIGHUP")
+				continue
+			case syscall.SIGUSR2:
+				// the new process takes over the listeners, this one drains like on SIGTERM
+				if err := upgrade(); err != nil {
+					logger.Errorf("Upgrade failed, keep serving, err %v", err)
+					continue
+				}
+				stopConsole(console)
+			}
+			shutdown(servers.All(), sig, signals)
+			return
+		}
+	}
+}
+
+func reload(r *configReloader, reason string) {
+	logger.Infof("Reloading config, %s", reason)
+	if err := r.Reload(); err != nil {
+		logger.Errorf("Config reload rejected, keep running the current one, err %v", err)
+	}
+}
+
+// stopConsole leaves the console to the process that took over on upgrade, changes made here would not reach it. The
+// requests already running are given consoleStopTimeout to finish.
+func stopConsole(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), consoleStopTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warnf("Console requests still running after %v, closing them, err %v", consoleStopTimeout, err)
+		server.Close()
+		return
+	}
+	logger.Infof("Console handed over to the new process")
+}
+
+// shutdown stops accepting on all listeners and waits up to global.draintimeout for the open connections to finish,
+// another signal meanwhile cuts the wait short
+func shutdown(servers []proxyServer, sig os.Signal, signals chan os.Signal) {
+	timeout := viper.GetDuration("global.draintimeout")
+	logger.Infof("Received %v, draining connections for up to %v", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warnf("Received %v again, closing connections now", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	wg := sync.WaitGroup{}
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s proxyServer) {
+			defer wg.Done()
+			s.Stop(ctx)
+		}(s)
 	}
+	wg.Wait()
+	logger.Infof("All connections closed, exiting")
+	logger.Sync()
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hosts beyond this many distinct names are accounted as "other", to bound the number of series
+const metricsMaxHosts = 1000
+
+var (
+	metrics            *Metrics
+	metricsDialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type metricValue struct {
+	labels []string
+	v      int64
+}
+
+// metricVec is a counter or gauge with labels, values are updated with atomic ops on the pointer returned by With
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]*metricValue
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		lock:   sync.Mutex{},
+		values: map[string]*metricValue{},
+	}
+}
+
+func (m *metricVec) With(values ...string) *int64 {
+	key := strings.Join(values, "\xff")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labels: values}
+		m.values[key] = v
+	}
+	return &v.v
+}
+
+func (m *metricVec) Add(delta int64, values ...string) {
+	atomic.AddInt64(m.With(values...), delta)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	m.lock.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := m.values[k]
+		fmt.Fprintf(w, "%s%s %d\n", m.name, formatMetricLabels(m.labels, v.labels), atomic.LoadInt64(&v.v))
+	}
+	m.lock.Unlock()
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+func newMetricHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		lock:    sync.Mutex{},
+		values:  map[string]*histogramValue{},
+	}
+}
+
+func (m *metricHistogram) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.values[key]
+	if !ok {
+		h = &histogramValue{labels: values, counts: make([]uint64, len(m.buckets))}
+		m.values[key] = h
+	}
+	for i, b := range m.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *metricHistogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	m.lock.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, m.labels...), "le")
+	for _, k := range keys {
+		h := m.values[k]
+		for i, b := range m.buckets {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatMetricLabels(labels, append(append([]string{}, h.labels...), le)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatMetricLabels(labels, append(append([]string{}, h.labels...), "+Inf")), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", m.name, formatMetricLabels(m.labels, h.labels), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatMetricLabels(m.labels, h.labels), h.count)
+	}
+	m.lock.Unlock()
+}
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		parts[i] = n + `="` + v + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type metricWriter interface {
+	write(w io.Writer)
+}
+
+// Metrics keeps the counters exported in the Prometheus text format on the console's /metrics
+type Metrics struct {
+	ConnectionsActive *metricVec
+	ConnectionsTotal  *metricVec
+	Bytes             *metricVec
+	DialSeconds       *metricHistogram
+	DialErrors        *metricVec
+	ConnectionErrors  *metricVec
+	ClientRejections  *metricVec
+	RuleCache         *metricVec
+	HTTPResponses     *metricVec
+	hosts             map[string]bool
+	hostsLock         sync.Mutex
+	all               []metricWriter
+}
+
+func NewMetrics() *Metrics {
+	ret := &Metrics{
+		ConnectionsActive: newMetricVec("rproxy_connections_active", "gauge", "Client connections currently open.", "listener", "scheme"),
+		ConnectionsTotal:  newMetricVec("rproxy_connections_total", "counter", "Client connections accepted.", "listener", "scheme"),
+		Bytes:             newMetricVec("rproxy_bytes_total", "counter", "Bytes proxied, up is client to upstream.", "rule", "host", "direction"),
+		DialSeconds:       newMetricHistogram("rproxy_upstream_dial_seconds", "Time to connect to upstream, including proxy handshakes.", metricsDialBuckets, "route"),
+		DialErrors:        newMetricVec("rproxy_upstream_dial_errors_total", "counter", "Failed upstream connects by reason.", "route", "reason"),
+		ConnectionErrors:  newMetricVec("rproxy_connection_errors_total", "counter", "Client connections refused or failed before proxying, by reason.", "scheme", "reason"),
+		ClientRejections:  newMetricVec("rproxy_client_rejections_total", "counter", "Clients turned away by an access control list, by the list deciding.", "scheme", "acl"),
+		RuleCache:         newMetricVec("rproxy_rule_cache_lookups_total", "counter", "Rule lookups answered by the rule cache (hit) or by matching patterns (miss).", "result"),
+		HTTPResponses:     newMetricVec("rproxy_http_responses_total", "counter", "HTTP responses sent to clients by status code.", "code"),
+		hosts:             map[string]bool{},
+		hostsLock:         sync.Mutex{},
+	}
+	ret.all = []metricWriter{ret.ConnectionsActive, ret.ConnectionsTotal, ret.Bytes, ret.DialSeconds, ret.DialErrors,
+		ret.ConnectionErrors, ret.ClientRejections, ret.RuleCache, ret.HTTPResponses}
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range ret.all {
+			m.write(w)
+		}
+	})
+	return ret
+}
+
+// HostLabel returns host as label value, or "other" once too many distinct hosts have been seen
+func (m *Metrics) HostLabel(host string) string {
+	host = strings.Trim(strings.ToLower(host), ".")
+	m.hostsLock.Lock()
+	defer m.hostsLock.Unlock()
+	if !m.hosts[host] {
+		if len(m.hosts) >= metricsMaxHosts {
+			return "other"
+		}
+		m.hosts[host] = true
+	}
+	return host
+}
+
+// TrafficCounters returns the up and down byte counters of a host and the rule matching it, empty for none
+func (m *Metrics) TrafficCounters(rule, host string) (*int64, *int64) {
+	if rule == "" {
+		rule = "none"
+	}
+	host = m.HostLabel(host)
+	return m.Bytes.With(rule, host, "up"), m.Bytes.With(rule, host, "down")
+}
+
+// errorReason maps an error to a short label value
+func errorReason(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errTargetRejected):
+		return "target_rejected"
+	case errors.Is(err, errClientDenied):
+		return "client_denied"
+	case errors.Is(err, errDestinationBlocked):
+		return "destination_blocked"
+	case errors.Is(err, errInvalidTLSPacket):
+		return "invalid_tls_packet"
+	case errors.Is(err, errInvaildClientHello):
+		return "invalid_client_hello"
+	case errors.Is(err, errInvalidTLSProtocol):
+		return "invalid_tls_protocol"
+	case errors.Is(err, errInvalidProxyProtocol):
+		return "invalid_proxy_protocol"
+	case errors.Is(err, errForwardLoop):
+		return "forward_loop"
+	case errors.Is(err, errUpstreamProxy):
+		return "upstream_proxy"
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// ObserveDial records the outcome of an upstream connect, route is "direct" or the proxy host
+func (m *Metrics) ObserveDial(route string, start time.Time, err error) {
+	if err != nil {
+		m.DialErrors.Add(1, route, errorReason(err))
+		return
+	}
+	m.DialSeconds.Observe(time.Since(start).Seconds(), route)
+}
+
+// countingConn adds the bytes read from a connection to a counter. Until a counter is set, reads are held in pending,
+// so a connection can be counted from its first byte even though its host is only known after the ClientHello. The
+// connection's own total and its first read error are kept for the access log.
+type countingConn struct {
+	net.Conn
+	counter *int64
+	pending int64
+	total   int64
+	readErr error
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.total, int64(n))
+	if err != nil && err != io.EOF && c.readErr == nil {
+		c.readErr = err
+	}
+	if c.counter != nil {
+		atomic.AddInt64(c.counter, int64(n))
+	} else {
+		c.pending += int64(n)
+	}
+	return n, err
+}
+
+// SetCounter must be called from the reading goroutine
+func (c *countingConn) SetCounter(counter *int64) {
+	atomic.AddInt64(counter, c.pending)
+	c.pending = 0
+	c.counter = counter
+}
+
+// Total returns the bytes read so far
+func (c *countingConn) Total() int64 {
+	return atomic.LoadInt64(&c.total)
+}
+
+// countingBody counts the bytes of an http request body
+type countingBody struct {
+	io.ReadCloser
+	counter *int64
+	total   int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.counter, int64(n))
+	atomic.AddInt64(&b.total, int64(n))
+	return n, err
+}
+
+// metricsResponseWriter records the status and counts the bytes of an http response
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	counter *int64
+	written int64
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.counter, int64(n))
+	atomic.AddInt64(&w.written, int64(n))
+	return n, err
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	proxyProtocolV1MaxLen     = 107
+	proxyProtocolV2HeadLen    = 16
+	proxyProtocolTLVAuthority = 0x02
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolEnabled tells whether PROXY protocol is turned on for a listener, the setting is either true for all
+// listeners of the section or a comma separated list of listen addresses
+func proxyProtocolEnabled(section string, listen string) bool {
+	v := strings.Trim(viper.GetString(section+".proxyprotocol"), " ")
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	for _, s := range strings.Split(v, ",") {
+		if strings.Trim(s, " ") == listen {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConfigured tells whether PROXY protocol is turned on for any listener
+func proxyProtocolConfigured(v *viper.Viper) bool {
+	for _, section := range []string{"http", "https"} {
+		s := strings.Trim(v.GetString(section+".proxyprotocol"), " ")
+		if b, err := strconv.ParseBool(s); err == nil {
+			if b {
+				return true
+			}
+			continue
+		}
+		if s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRList parses comma separated networks, a bare address is a single host network
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	ret := []*net.IPNet{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.Trim(c, " ")
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: c}
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ProxyProtocolListener accepts connections carrying a HAProxy PROXY protocol v1 or v2 header, so that the real client
+// address is seen behind an L4 load balancer. Only peers in the trusted list may send the header, connections from
+// anywhere else are passed through untouched.
+type ProxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewProxyProtocolListener refuses an empty proxyprotocol.trusted, trusting every peer has to be asked for explicitly
+// with 0.0.0.0/0,::/0
+func NewProxyProtocolListener(l net.Listener) (*ProxyProtocolListener, error) {
+	trusted, err := parseProxyProtocolTrusted(viper.GetString("proxyprotocol.trusted"))
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyProtocolListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  viper.GetDuration("proxyprotocol.timeout"),
+	}, nil
+}
+
+func parseProxyProtocolTrusted(s string) ([]*net.IPNet, error) {
+	trusted, err := parseCIDRList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxyprotocol.trusted, %w", err)
+	}
+	if len(trusted) == 0 {
+		return nil, errProxyProtocolUntrusted
+	}
+	return trusted, nil
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !containsIP(l.trusted, addrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+// proxyProtocolConn reads the header on first use rather than in Accept, so a slow peer can't hold up the listener
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	err     error
+	remote  net.Addr
+	local   net.Addr
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.remote, c.local = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		src, dst, err := readProxyProtocolHeader(c.reader)
+		if err != nil {
+			logger.Warnf("Invalid PROXY protocol header from %s, err %v", c.remote, err)
+			c.err = err
+			return
+		}
+		if src != nil {
+			c.remote, c.local = src, dst
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	return c.local
+}
+
+// readProxyProtocolHeader consumes a v1 or v2 header, addresses are nil for LOCAL and UNKNOWN connections
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, nil, errInvalidProxyProtocol
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyProtocolV1MaxLen)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, nil, errInvalidProxyProtocol
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		if b == '\n' && !bytes.HasSuffix(line, []byte("\r")) {
+			// the line has to end with CRLF, don't wait for one that won't come
+			return nil, nil, errInvalidProxyProtocol
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	return &net.TCPAddr{IP: src, Port: int(sport)}, &net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, proxyProtocolV2HeadLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	data := make([]byte, makeNetworkInt(head[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	switch head[12] & 0xf {
+	case 0:
+		// LOCAL, health checks of the balancer itself
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, errInvalidProxyProtocol
+	}
+	// TLVs following the addresses are of no interest here
+	switch head[13] {
+	case 0x11:
+		if len(data) < 12 {
+			return nil, nil, errInvalidProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: makeNetworkInt(data[8:10])},
+			&net.TCPAddr{IP: net.IP(data[4:8]), Port: makeNetworkInt(data[10:12])}, nil
+	case 0x21:
+		if len(data) < 36 {
+			return nil, nil, errInvalidProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: makeNetworkInt(data[32:34])},
+			&net.TCPAddr{IP: net.IP(data[16:32]), Port: makeNetworkInt(data[34:36])}, nil
+	}
+	// UNSPEC, UDP or unix sockets, keep the real peer
+	return nil, nil, nil
+}
+
+// buildProxyProtocolHeader encodes the client and destination addresses of a proxied connection. Addresses of
+// different families, or not TCP, become UNKNOWN/UNSPEC so that the backend falls back to the real peer. The authority
+// TLV (the requested host name) is only carried by v2.
+func buildProxyProtocolHeader(version int, src, dst net.Addr, authority string) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	v4 := sok && dok && s.IP.To4() != nil && d.IP.To4() != nil
+	v6 := sok && dok && !v4 && s.IP.To4() == nil && d.IP.To4() == nil
+	if version == 1 {
+		switch {
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+		case v6:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+		}
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	body := []byte{}
+	family := byte(0x00)
+	switch {
+	case v4:
+		family = 0x11
+		body = append(body, s.IP.To4()...)
+		body = append(body, d.IP.To4()...)
+	case v6:
+		family = 0x21
+		body = append(body, s.IP.To16()...)
+		body = append(body, d.IP.To16()...)
+	}
+	if v4 || v6 {
+		body = appendNetworkInt(body, s.Port, 2)
+		body = appendNetworkInt(body, d.Port, 2)
+	}
+	if authority != "" && len(authority) <= 0xffff {
+		body = append(body, proxyProtocolTLVAuthority)
+		body = appendNetworkInt(body, len(authority), 2)
+		body = append(body, authority...)
+	}
+	ret := append([]byte{}, proxyProtocolV2Sig...)
+	ret = append(ret, 0x21, family)
+	ret = appendNetworkInt(ret, len(body), 2)
+	return append(ret, body...)
+}
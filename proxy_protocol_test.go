@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func testReadProxyProtocol(header []byte) (net.Addr, net.Addr, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, header...), "payload"...)))
+	src, dst, err := readProxyProtocolHeader(r)
+	rest, _ := io.ReadAll(r)
+	return src, dst, rest, err
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	tests := []struct {
+		name   string
+		header []byte
+		src    string
+		dst    string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n"), "", ""},
+		{"v1 built", buildProxyProtocolHeader(1, v4src, v4dst, "www.example.com"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 tcp4", buildProxyProtocolHeader(2, v4src, v4dst, ""), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 tcp6", buildProxyProtocolHeader(2, v6src, v6dst, ""), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v2 with authority TLV", buildProxyProtocolHeader(2, v4src, v4dst, "www.example.com"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 mixed families", buildProxyProtocolHeader(2, v4src, v6dst, ""), "", ""},
+		{"v2 local", append(append([]byte{}, proxyProtocolV2Sig...), 0x20, 0x00, 0, 0), "", ""},
+		{"v2 udp4", append(append([]byte{}, proxyProtocolV2Sig...), append([]byte{0x21, 0x12, 0, 12}, make([]byte, 12)...)...), "", ""},
+	}
+	for _, tt := range tests {
+		src, dst, rest, err := testReadProxyProtocol(tt.header)
+		if err != nil {
+			t.Errorf("%s: readProxyProtocolHeader err %v", tt.name, err)
+			continue
+		}
+		if tt.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("%s: got %v -> %v, want the real peer", tt.name, src, dst)
+			}
+		} else if src == nil || dst == nil || src.String() != tt.src || dst.String() != tt.dst {
+			t.Errorf("%s: got %v -> %v, want %s -> %s", tt.name, src, dst, tt.src, tt.dst)
+		}
+		if string(rest) != "payload" {
+			t.Errorf("%s: the header was not consumed exactly, %q left", tt.name, rest)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderInvalid(t *testing.T) {
+	v2 := func(b ...byte) []byte {
+		return append(append([]byte{}, proxyProtocolV2Sig...), b...)
+	}
+	tests := []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), errInvalidProxyProtocol},
+		{"lower case", []byte("proxy TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), errInvalidProxyProtocol},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), errInvalidProxyProtocol},
+		{"v1 extra field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443 x\r\n"), errInvalidProxyProtocol},
+		{"v1 udp", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), errInvalidProxyProtocol},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"), errInvalidProxyProtocol},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), errInvalidProxyProtocol},
+		{"v1 negative port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 -1 443\r\n"), errInvalidProxyProtocol},
+		{"v1 bare newline", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), errInvalidProxyProtocol},
+		{"v1 too long", append([]byte("PROXY TCP6 "), bytes.Repeat([]byte("f"), 200)...), errInvalidProxyProtocol},
+		{"v2 version 1", v2(0x11, 0x11, 0, 12), errInvalidProxyProtocol},
+		{"v2 unknown command", v2(append([]byte{0x22, 0x11, 0, 12}, make([]byte, 12)...)...), errInvalidProxyProtocol},
+		{"v2 short tcp4 addresses", v2(0x21, 0x11, 0, 4, 192, 0, 2, 1), errInvalidProxyProtocol},
+		{"v2 short tcp6 addresses", v2(append([]byte{0x21, 0x21, 0, 12}, make([]byte, 12)...)...), errInvalidProxyProtocol},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := testReadProxyProtocol(tt.header); !errors.Is(err, tt.err) {
+			t.Errorf("%s: readProxyProtocolHeader err %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderTruncated(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+		buildProxyProtocolHeader(2, src, dst, "www.example.com"),
+	} {
+		for n := 0; n < len(header); n++ {
+			_, _, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header[:n])))
+			if err == nil {
+				t.Errorf("%q truncated to %d bytes: readProxyProtocolHeader wants an error", header, n)
+			}
+		}
+	}
+}
+
+func TestParseProxyProtocolTrusted(t *testing.T) {
+	tests := []struct {
+		trusted string
+		err     error
+		ok      bool
+	}{
+		{"10.0.0.0/24,192.0.2.10", nil, true},
+		{"0.0.0.0/0,::/0", nil, true},
+		{"", errProxyProtocolUntrusted, false},
+		{" , ", errProxyProtocolUntrusted, false},
+		{"10.0.0.0/33", nil, false},
+	}
+	for _, tt := range tests {
+		_, err := parseProxyProtocolTrusted(tt.trusted)
+		if (err == nil) != tt.ok || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("parseProxyProtocolTrusted(%q) err %v", tt.trusted, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const configWatchInterval = 2 * time.Second
+
+// configLock guards the global viper settings while a reload replaces them. Startup and the reload itself run on the
+// main goroutine and read them freely, goroutines that may run meanwhile, like the console handlers, read under it.
+var configLock sync.RWMutex
+
+// reloadableSettings take effect on reload, changes to anything else are only reported
+var reloadableSettings = map[string]bool{
+	"https.listen":             true,
+	"http.listen":              true,
+	"dns.listen":               true,
+	"global.outip":             true,
+	"global.logfile":           true,
+	"global.errfile":           true,
+	"global.draintimeout":      true,
+	"client.passthrough":       true,
+	"client.rules":             true,
+	"client.rulesbackups":      true,
+	"accesslog.file":           true,
+	"accesslog.format":         true,
+	"acl.allow":                true,
+	"acl.deny":                 true,
+	"acl.listeners":            true,
+	"destination.blockprivate": true,
+	"destination.allow":        true,
+	"destination.deny":         true,
+	"console.tokens":           true,
+	"console.users":            true,
+	"console.certs":            true,
+	"console.auditlog":         true,
+}
+
+// secretSettings are logged as a hash when they change
+var secretSettings = map[string]bool{
+	"console.tokens": true,
+	"console.users":  true,
+}
+
+// serverSet runs a server for every configured listen address, keyed by "scheme listen"
+type serverSet struct {
+	rules   *ForwardRules
+	lock    sync.Mutex
+	running map[string]proxyServer
+}
+
+func newServerSet(rules *ForwardRules) *serverSet {
+	return &serverSet{
+		rules:   rules,
+		lock:    sync.Mutex{},
+		running: map[string]proxyServer{},
+	}
+}
+
+// configuredServers lists the listeners a configuration asks for
+func configuredServers(v *viper.Viper) []string {
+	ret := []string{}
+	for _, scheme := range []string{"https", "http", "dns"} {
+		for _, s := range strings.Split(v.GetString(scheme+".listen"), ",") {
+			if s = strings.Trim(s, " "); s != "" {
+				ret = append(ret, scheme+" "+s)
+			}
+		}
+	}
+	return ret
+}
+
+func (s *serverSet) newServer(key string) proxyServer {
+	parts := strings.SplitN(key, " ", 2)
+	switch parts[0] {
+	case "https":
+		return NewHTTPSProxy(s.rules, parts[1])
+	case "http":
+		return NewHTTPProxy(s.rules, parts[1])
+	}
+	return NewDNSServer(s.rules, parts[1])
+}
+
+// Update starts the configured listeners that aren't running yet, and returns those running but no longer
+// configured. If one fails to start, the ones started by this call are stopped again.
+func (s *serverSet) Update() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	configured := map[string]bool{}
+	started := []string{}
+	for _, key := range configuredServers(viper.GetViper()) {
+		configured[key] = true
+		if _, ok := s.running[key]; ok {
+			continue
+		}
+		server := s.newServer(key)
+		if err := server.Start(); err != nil {
+			for _, k := range started {
+				s.running[k].Stop(context.Background())
+				delete(s.running, k)
+			}
+			return nil, err
+		}
+		s.running[key] = server
+		started = append(started, key)
+	}
+	stale := []string{}
+	for key := range s.running {
+		if !configured[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// Remove stops servers in the background, letting their connections drain for up to global.draintimeout
+func (s *serverSet) Remove(keys []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	timeout := viper.GetDuration("global.draintimeout")
+	for _, key := range keys {
+		server, ok := s.running[key]
+		if !ok {
+			continue
+		}
+		delete(s.running, key)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			server.Stop(ctx)
+		}()
+	}
+}
+
+func (s *serverSet) All() []proxyServer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ret := []proxyServer{}
+	for _, server := range s.running {
+		ret = append(ret, server)
+	}
+	return ret
+}
+
+// configReloader applies changes of the config file, on SIGHUP or when the file is seen changing
+type configReloader struct {
+	servers *serverSet
+	rules   *ForwardRules
+	data    []byte
+	changed chan struct{}
+}
+
+func newConfigReloader(servers *serverSet, rules *ForwardRules) *configReloader {
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		logger.Fatalf("Unable to read config file %s, err %v", viper.ConfigFileUsed(), err)
+		return nil
+	}
+	ret := &configReloader{
+		servers: servers,
+		rules:   rules,
+		data:    data,
+		changed: make(chan struct{}, 1),
+	}
+	go ret.watch()
+	return ret
+}
+
+// watch polls the config file, a change of its size or modification time triggers a reload
+func (r *configReloader) watch() {
+	fn := viper.ConfigFileUsed()
+	var last os.FileInfo
+	for {
+		if fi, err := os.Stat(fn); err == nil {
+			if last != nil && (fi.Size() != last.Size() || !fi.ModTime().Equal(last.ModTime())) {
+				select {
+				case r.changed <- struct{}{}:
+				default:
+				}
+			}
+			last = fi
+		}
+		time.Sleep(configWatchInterval)
+	}
+}
+
+// readGlobalConfig replaces the global viper settings
+func readGlobalConfig(data []byte) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
+// checkWritable tells whether a log file can be opened, stdout and stderr always can
+func checkWritable(fn string) error {
+	switch fn {
+	case "", "stdout", "stderr":
+		return nil
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validateConfig checks what NewX constructors would otherwise refuse with a fatal error
+func validateConfig(v *viper.Viper) error {
+	for _, key := range configuredServers(v) {
+		listen := strings.SplitN(key, " ", 2)[1]
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return fmt.Errorf("invalid %s listen address, %w", key, err)
+		}
+	}
+	if v.GetString("dns.listen") != "" {
+		count := 0
+		for _, s := range strings.Split(v.GetString("dns.address"), ",") {
+			if s = strings.Trim(s, " "); s == "" {
+				continue
+			}
+			if net.ParseIP(s) == nil {
+				return fmt.Errorf("invalid dns answer address %s", s)
+			}
+			count++
+		}
+		if count == 0 {
+			return fmt.Errorf("dns.listen set but no dns.address configured")
+		}
+	}
+	if _, err := parseProxyProtocolVersion(v.GetString("upstream.proxyprotocol")); err != nil {
+		return fmt.Errorf("invalid upstream.proxyprotocol, %w", err)
+	}
+	if trusted, err := parseCIDRList(v.GetString("proxyprotocol.trusted")); err != nil {
+		return fmt.Errorf("invalid proxyprotocol.trusted, %w", err)
+	} else if len(trusted) == 0 && proxyProtocolConfigured(v) {
+		return errProxyProtocolUntrusted
+	}
+	if _, err := parseUpstreamProxy(v.GetString("upstream.proxy")); err != nil {
+		return fmt.Errorf("invalid upstream.proxy, %w", err)
+	}
+	if _, err := parseAccessLogFormat(v.GetString("accesslog.format")); err != nil {
+		return err
+	}
+	for _, key := range []string{"global.logfile", "global.errfile", "accesslog.file", "console.auditlog"} {
+		if err := checkWritable(v.GetString(key)); err != nil {
+			return fmt.Errorf("unable to open %s, %w", key, err)
+		}
+	}
+	return nil
+}
+
+// flattenSettings turns nested settings into "section.key" values, passwords in urls and secrets are masked
+func flattenSettings(prefix string, settings map[string]interface{}, out map[string]string) map[string]string {
+	for k, v := range settings {
+		if m, ok := v.(map[string]interface{}); ok {
+			flattenSettings(prefix+k+".", m, out)
+			continue
+		}
+		s := fmt.Sprint(v)
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			s = u.Redacted()
+		}
+		if secretSettings[prefix+k] {
+			sum := sha256.Sum256([]byte(s))
+			s = "sha256:" + hex.EncodeToString(sum[:6])
+		}
+		out[prefix+k] = s
+	}
+	return out
+}
+
+// Reload reads the config file again and applies it. Nothing is changed when the new config is invalid or a new
+// listener can't be started.
+func (r *configReloader) Reload() error {
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	setupDefaults(v)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := validateConfig(v); err != nil {
+		return err
+	}
+	d, err := newDialer(v.GetString("global.outip"))
+	if err != nil {
+		return err
+	}
+	acl, err := newClientACL(v)
+	if err != nil {
+		return err
+	}
+	policy, err := newDestinationPolicy(v)
+	if err != nil {
+		return err
+	}
+	creds, err := newConsoleCredentials(v)
+	if err != nil {
+		return err
+	}
+	rules, err := readRuleFile(v.GetString("client.rules"))
+	if err != nil {
+		return fmt.Errorf("unable to load %s, %w", v.GetString("client.rules"), err)
+	}
+
+	oldSettings := flattenSettings("", viper.AllSettings(), map[string]string{})
+	newSettings := flattenSettings("", v.AllSettings(), map[string]string{})
+	oldListens := proxyListens(viper.GetViper())
+	if err := readGlobalConfig(data); err != nil {
+		return err
+	}
+	// new listeners are protected from the moment they start, the stale ones until they are stopped below
+	loopDetector.SetListens(append(append([]string{}, oldListens...), proxyListens(v)...))
+	stale, err := r.servers.Update()
+	if err != nil {
+		readGlobalConfig(r.data)
+		loopDetector.SetListens(oldListens)
+		return err
+	}
+	r.data = data
+	// reopened first, so that what follows is logged to the new files after a rotation
+	if err := reopenLogs(viper.GetString("global.logfile"), viper.GetString("global.errfile")); err != nil {
+		logger.Errorf("Unable to reopen log files, err %v", err)
+	}
+	if err := accessLog.Reload(viper.GetString("accesslog.file"), viper.GetString("accesslog.format")); err != nil {
+		logger.Errorf("Unable to reopen the access log, err %v", err)
+	}
+	if err := consoleAuth.Reload(creds, viper.GetString("console.auditlog")); err != nil {
+		logger.Errorf("Unable to reopen the console audit log, err %v", err)
+	}
+
+	keys := []string{}
+	for k := range oldSettings {
+		keys = append(keys, k)
+	}
+	for k := range newSettings {
+		if _, ok := oldSettings[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	changes := 0
+	for _, k := range keys {
+		if oldSettings[k] == newSettings[k] {
+			continue
+		}
+		changes++
+		if reloadableSettings[k] {
+			logger.Infow("config changed", "key", k, "old", oldSettings[k], "new", newSettings[k])
+		} else {
+			logger.Warnw("config changed, takes effect after a restart", "key", k, "old", oldSettings[k], "new", newSettings[k])
+		}
+	}
+
+	upstreamDialer.Store(d)
+	clientACL.Store(acl)
+	destinationPolicy.Store(policy)
+	upstreamTransport.CloseIdleConnections()
+	r.rules.SetPassThrough(viper.GetBool("client.passthrough"))
+	if rules != nil {
+		rulesAPI.Reloaded(rules)
+	}
+	r.servers.Remove(stale)
+	loopDetector.SetListens(proxyListens(v))
+	for _, key := range stale {
+		logger.Infof("Stopped %s", key)
+	}
+	logger.Infof("Config reloaded, %d settings changed, rules reloaded from %s", changes, viper.GetString("client.rules"))
+	return nil
+}
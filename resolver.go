@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const resolverMaxCacheEntries = 10000
+
+var (
+	resolver *Resolver
+)
+
+type resolverCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Resolver looks up upstream targets without going through the system resolver, which is likely hijacked to rproxy
+// itself. Servers are given as udp://, tcp://, tls:// (DoT) or https:// (DoH) URLs, a bare address means udp.
+// When no server is configured, the system resolver is used without caching.
+type Resolver struct {
+	servers     []*url.URL
+	hosts       map[string][]net.IP
+	cache       map[string]*resolverCacheEntry
+	cacheLock   sync.Mutex
+	timeout     time.Duration
+	negativeTTL time.Duration
+	httpClient  *http.Client
+}
+
+func NewResolver() *Resolver {
+	ret := &Resolver{
+		servers:     []*url.URL{},
+		hosts:       map[string][]net.IP{},
+		cache:       map[string]*resolverCacheEntry{},
+		cacheLock:   sync.Mutex{},
+		timeout:     viper.GetDuration("resolver.timeout"),
+		negativeTTL: viper.GetDuration("resolver.negativettl"),
+	}
+	for _, s := range strings.Split(viper.GetString("resolver.servers"), ",") {
+		s = strings.Trim(s, " ")
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "://") {
+			s = "udp://" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			logger.Fatalf("Invalid resolver server %s, err %v", s, err)
+			return nil
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			u.Host = ensurePort(u.Host, "53")
+		case "tls":
+			u.Host = ensurePort(u.Host, "853")
+		case "https":
+		default:
+			logger.Fatalf("Unsupported resolver server scheme %s", u.Scheme)
+			return nil
+		}
+		ret.servers = append(ret.servers, u)
+	}
+	for host, addrs := range viper.GetStringMapString("resolver.hosts") {
+		host = strings.Trim(strings.ToLower(host), ".")
+		for _, s := range strings.Split(addrs, ",") {
+			ip := net.ParseIP(strings.Trim(s, " "))
+			if ip == nil {
+				logger.Fatalf("Invalid static address %s for host %s", s, host)
+				return nil
+			}
+			ret.hosts[host] = append(ret.hosts[host], ip)
+		}
+	}
+	ret.httpClient = &http.Client{
+		Timeout: ret.timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     time.Second * 30,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return currentDialer().DialContext(ctx, network, address)
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	return ret
+}
+
+func ensurePort(hostport string, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+	}
+	return hostport
+}
+
+// LookupIP returns the addresses of host, IPv4 first
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.Trim(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	if len(r.servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ret := []net.IP{}
+		for _, a := range addrs {
+			ret = append(ret, a.IP)
+		}
+		return ret, nil
+	}
+	var v4, v6 []net.IP
+	var err4, err6 error
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v6, err6 = r.lookupType(ctx, host, dnsTypeAAAA)
+	}()
+	v4, err4 = r.lookupType(ctx, host, dnsTypeA)
+	wg.Wait()
+	ret := append(v4, v6...)
+	if len(ret) == 0 {
+		if err4 != nil {
+			return nil, err4
+		}
+		if err6 != nil {
+			return nil, err6
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ret, nil
+}
+
+func (r *Resolver) lookupType(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	key := host + "/" + dnsTypeName(qtype)
+	r.cacheLock.Lock()
+	if e, ok := r.cache[key]; ok {
+		if time.Now().Before(e.expires) {
+			r.cacheLock.Unlock()
+			return e.ips, nil
+		}
+		delete(r.cache, key)
+	}
+	r.cacheLock.Unlock()
+
+	id := make([]byte, 2)
+	rand.Read(id)
+	query := &dnsMessage{
+		ID:        uint16(makeNetworkInt(id)),
+		Flags:     dnsFlagRecursionDesired,
+		Questions: []dnsQuestion{{Name: host, Type: qtype, Class: dnsClassINET}},
+	}
+	var lastErr error
+	for _, server := range r.servers {
+		reply, err := r.exchange(ctx, server, query)
+		if err != nil {
+			logger.Infow("resolver query fail", "server", server.String(), "host", host, "err", err)
+			lastErr = err
+			continue
+		}
+		if reply.Rcode() != dnsRcodeSuccess && reply.Rcode() != dnsRcodeNameError {
+			logger.Infow("resolver query fail", "server", server.String(), "host", host, "rcode", reply.Rcode())
+			lastErr = &net.DNSError{Err: "server misbehaving", Name: host, Server: server.String()}
+			continue
+		}
+		ips := []net.IP{}
+		ttl := uint32(0)
+		for _, a := range reply.Answers {
+			if a.Type != qtype || a.Class != dnsClassINET {
+				continue
+			}
+			if (qtype == dnsTypeA && len(a.Data) != net.IPv4len) || (qtype == dnsTypeAAAA && len(a.Data) != net.IPv6len) {
+				continue
+			}
+			ips = append(ips, net.IP(append([]byte{}, a.Data...)))
+			if ttl == 0 || a.TTL < ttl {
+				ttl = a.TTL
+			}
+		}
+		expires := time.Now().Add(time.Duration(ttl) * time.Second)
+		if len(ips) == 0 {
+			expires = time.Now().Add(r.negativeTTL)
+		}
+		r.store(key, ips, expires)
+		return ips, nil
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) store(key string, ips []net.IP, expires time.Time) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	if len(r.cache) >= resolverMaxCacheEntries {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= resolverMaxCacheEntries {
+			r.cache = map[string]*resolverCacheEntry{}
+		}
+	}
+	r.cache[key] = &resolverCacheEntry{
+		ips:     ips,
+		expires: expires,
+	}
+}
+
+func (r *Resolver) exchange(ctx context.Context, server *url.URL, query *dnsMessage) (*dnsMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	data := query.Pack()
+	var reply []byte
+	var err error
+	switch server.Scheme {
+	case "udp":
+		reply, err = r.exchangeConn(ctx, "udp", server, data)
+		if err == nil && len(reply) >= 4 && uint16(makeNetworkInt(reply[2:4]))&dnsFlagTruncated != 0 {
+			reply, err = r.exchangeConn(ctx, "tcp", server, data)
+		}
+	case "tcp", "tls":
+		reply, err = r.exchangeConn(ctx, server.Scheme, server, data)
+	case "https":
+		reply, err = r.exchangeHTTPS(ctx, server, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret, err := parseDNSMessage(reply)
+	if err != nil {
+		return nil, err
+	}
+	if ret.ID != query.ID && server.Scheme != "https" {
+		return nil, errInvalidDNSMessage
+	}
+	return ret, nil
+}
+
+func (r *Resolver) exchangeConn(ctx context.Context, network string, server *url.URL, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if network == "tls" {
+		td := tls.Dialer{
+			NetDialer: currentDialer(),
+			Config:    &tls.Config{ServerName: server.Hostname()},
+		}
+		conn, err = td.DialContext(ctx, "tcp", server.Host)
+	} else {
+		d := *currentDialer()
+		if a, ok := d.LocalAddr.(*net.TCPAddr); ok && network == "udp" {
+			// global.outip is bound as a TCP address, queries over UDP go out from the same IP
+			d.LocalAddr = &net.UDPAddr{IP: a.IP}
+		}
+		conn, err = d.DialContext(ctx, network, server.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network != "udp" {
+		return exchangeDNSStream(conn, query)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, server *url.URL, query []byte) ([]byte, error) {
+	// RFC 8484 recommends id 0 for cache friendliness
+	query = append([]byte{0, 0}, query[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: "unexpected http status " + resp.Status, Server: server.String()}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func dnsTypeName(t uint16) string {
+	switch t {
+	case dnsTypeA:
+		return "A"
+	case dnsTypeAAAA:
+		return "AAAA"
+	}
+	return "unknown"
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// actions recorded in the rules history
+const (
+	ruleActionLoad     = "load"
+	ruleActionReload   = "reload"
+	ruleActionReplace  = "replace"
+	ruleActionPut      = "put"
+	ruleActionDelete   = "delete"
+	ruleActionRollback = "rollback"
+)
+
+const ruleHistoryDefaultLimit = 50
+
+var (
+	rulesAPI *RulesAPI
+
+	errRulesChanged  = errors.New("rules changed meanwhile, If-Match does not match")
+	errRuleNotFound  = errors.New("no such rule")
+	errNoRuleHistory = errors.New("no rules history file configured")
+	errRulesNotSaved = errors.New("unable to save rules")
+)
+
+// ruleChange is one pattern added, changed or removed, a missing side is null
+type ruleChange struct {
+	Pattern string          `json:"pattern"`
+	Old     json.RawMessage `json:"old"`
+	New     json.RawMessage `json:"new"`
+}
+
+// ruleRevision is a line of the rules history, holding the complete rule set after the change for rollbacks
+type ruleRevision struct {
+	Revision   uint64                     `json:"revision"`
+	Time       time.Time                  `json:"time"`
+	Identity   string                     `json:"identity"`
+	Client     string                     `json:"client"`
+	Action     string                     `json:"action"`
+	RollbackTo uint64                     `json:"rollback_to,omitempty"`
+	Changes    []ruleChange               `json:"changes"`
+	ETag       string                     `json:"etag"`
+	Rules      map[string]json.RawMessage `json:"rules,omitempty"`
+}
+
+// RulesAPI changes the rules through the console, whole or one pattern at a time. Changes are serialized, checked
+// against the ETag of the rule set the client saw when it sends If-Match, saved to client.rules and appended to the
+// history in client.ruleshistory.
+type RulesAPI struct {
+	rules    *ForwardRules
+	lock     sync.Mutex
+	history  string
+	revision uint64
+	// the history is trimmed to the newest maxLines once it holds a quarter more
+	lines    int
+	maxLines int
+}
+
+// rulesETag identifies the content of a rule set, json.Marshal sorts the patterns and compacts the values
+func rulesETag(entries map[string]json.RawMessage) string {
+	data, _ := json.Marshal(entries)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// ruleHistoryFile is client.ruleshistory, or the rules file with a .history suffix
+func ruleHistoryFile() string {
+	if fn := viper.GetString("client.ruleshistory"); fn != "" {
+		return GetFileLocation(fn)
+	}
+	if fn := GetFileLocation(viper.GetString("client.rules")); fn != "" {
+		return fn + ".history"
+	}
+	return ""
+}
+
+func NewRulesAPI(rules *ForwardRules) *RulesAPI {
+	ret := &RulesAPI{
+		rules:    rules,
+		lock:     sync.Mutex{},
+		history:  ruleHistoryFile(),
+		maxLines: viper.GetInt("client.ruleshistorymax"),
+	}
+	if err := ret.load(); err != nil {
+		logger.Fatalf("Load rules history %s failed, err %v", ret.history, err)
+		return nil
+	}
+	http.HandleFunc("/config/get", ret.handleGet)
+	http.HandleFunc("/config/update", ret.handleUpdate)
+	http.HandleFunc("/rules/rule", ret.handleRule)
+	http.HandleFunc("/rules/history", ret.handleHistory)
+	http.HandleFunc("/rules/rollback", ret.handleRollback)
+	return ret
+}
+
+// load picks up the revision count of the history, and records the rule set in use when it isn't the last revision
+func (a *RulesAPI) load() error {
+	last, torn, err := a.readHistory(func(rev *ruleRevision) bool {
+		a.lines++
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if torn >= 0 {
+		// a crash while appending, the revision never made it to the history
+		logger.Errorw("RULES HISTORY ENDS WITH AN UNPARSABLE LINE, DROPPING IT", "file", a.history, "offset", torn)
+		if err := os.Truncate(a.history, torn); err != nil {
+			return fmt.Errorf("unable to drop the last line, %w", err)
+		}
+	}
+	var old map[string]json.RawMessage
+	if last != nil {
+		a.revision, old = last.Revision, last.Rules
+	}
+	// the rules file was edited by hand, or this is the first start with a history
+	current := a.rules.Entries()
+	if a.history != "" && (last == nil || last.ETag != rulesETag(current)) {
+		a.record(&http.Request{}, &ruleRevision{Action: ruleActionLoad}, old, current)
+	}
+	return nil
+}
+
+// readHistory calls fn for every revision in the history until it returns true, and returns the last revision read.
+// An unparsable last line, torn by a crash while appending, is skipped and its offset returned in torn, which is -1
+// otherwise. An unparsable line followed by others is an error.
+func (a *RulesAPI) readHistory(fn func(rev *ruleRevision) bool) (*ruleRevision, int64, error) {
+	if a.history == "" {
+		return nil, -1, nil
+	}
+	f, err := os.Open(a.history)
+	if os.IsNotExist(err) {
+		return nil, -1, nil
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	// every line carries a whole rule set
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var last *ruleRevision
+	var offset int64
+	torn, tornLine, tornErr := int64(-1), 0, error(nil)
+	for line := 1; scanner.Scan(); line++ {
+		start := offset
+		offset += int64(len(scanner.Bytes())) + 1
+		if len(bytes.Trim(scanner.Bytes(), " \r\n")) == 0 {
+			continue
+		}
+		if torn >= 0 {
+			return nil, -1, fmt.Errorf("invalid history line %d, %w", tornLine, tornErr)
+		}
+		rev := &ruleRevision{}
+		if err := json.Unmarshal(scanner.Bytes(), rev); err != nil {
+			torn, tornLine, tornErr = start, line, err
+			continue
+		}
+		last = rev
+		if fn(rev) {
+			break
+		}
+	}
+	return last, torn, scanner.Err()
+}
+
+// trimHistory rewrites the history with its newest maxLines revisions. The caller holds the lock.
+func (a *RulesAPI) trimHistory() error {
+	data, err := ioutil.ReadFile(a.history)
+	if err != nil {
+		return err
+	}
+	lines := [][]byte{}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(bytes.Trim(line, " \r\n")) != 0 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > a.maxLines {
+		lines = lines[len(lines)-a.maxLines:]
+	}
+	if err := writeFileAtomic(a.history, bytes.Join(lines, nil), 0644); err != nil {
+		return err
+	}
+	a.lines = len(lines)
+	return nil
+}
+
+// diffRules lists the patterns whose values differ, sorted by pattern
+func diffRules(old, new map[string]json.RawMessage) []ruleChange {
+	compact := func(v json.RawMessage) string {
+		buf := &bytes.Buffer{}
+		if err := json.Compact(buf, v); err != nil {
+			return string(v)
+		}
+		return buf.String()
+	}
+	ret := []ruleChange{}
+	for k, v := range old {
+		if nv, ok := new[k]; !ok {
+			ret = append(ret, ruleChange{Pattern: k, Old: v})
+		} else if compact(v) != compact(nv) {
+			ret = append(ret, ruleChange{Pattern: k, Old: v, New: nv})
+		}
+	}
+	for k, v := range new {
+		if _, ok := old[k]; !ok {
+			ret = append(ret, ruleChange{Pattern: k, New: v})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Pattern < ret[j].Pattern
+	})
+	return ret
+}
+
+// record fills in rev, which has its action set, and appends it to the history. The caller holds the lock.
+func (a *RulesAPI) record(r *http.Request, rev *ruleRevision, old, new map[string]json.RawMessage) *ruleRevision {
+	a.revision++
+	rev.Revision = a.revision
+	rev.Time = time.Now()
+	rev.Identity = consoleIdentity(r)
+	rev.Client = r.RemoteAddr
+	rev.Changes = diffRules(old, new)
+	rev.ETag = rulesETag(new)
+	rev.Rules = new
+	if rev.Action == ruleActionLoad || rev.Action == ruleActionReload {
+		rev.Identity = "file"
+	}
+	logger.Infow("rules changed", "revision", rev.Revision, "action", rev.Action, "identity", rev.Identity,
+		"client", rev.Client, "changes", len(rev.Changes))
+	if a.history == "" {
+		return rev
+	}
+	line, _ := json.Marshal(rev)
+	f, err := os.OpenFile(a.history, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			if _, err = f.Write(append(line, '\n')); err == nil {
+				err = f.Sync()
+			} else {
+				// don't leave a partial line for the next revision to be appended to
+				f.Truncate(fi.Size())
+			}
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		logger.Errorf("Unable to append revision %d to the rules history %s, err %v", rev.Revision, a.history, err)
+		return rev
+	}
+	a.lines++
+	if a.maxLines > 0 && a.lines > a.maxLines+a.maxLines/4 {
+		if err := a.trimHistory(); err != nil {
+			logger.Errorf("Unable to trim the rules history %s, err %v", a.history, err)
+		}
+	}
+	return rev
+}
+
+// change applies edit to a copy of the rule set in use, then puts the result in use, saves it and records it as rev.
+// With an If-Match header the change is refused when the rule set isn't the one the client saw.
+func (a *RulesAPI) change(r *http.Request, rev *ruleRevision, edit func(entries map[string]json.RawMessage) error) (*ruleRevision, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	old := a.rules.Entries()
+	if m := strings.Trim(r.Header.Get("If-Match"), " "); m != "" && m != "*" && m != rulesETag(old) {
+		return nil, errRulesChanged
+	}
+	entries := a.rules.Entries()
+	if err := edit(entries); err != nil {
+		return nil, err
+	}
+	rules, err := buildRuleMap(entries)
+	if err != nil {
+		return nil, err
+	}
+	a.rules.setRules(rules)
+	if err := a.rules.Save(); err != nil {
+		prev, _ := buildRuleMap(old)
+		a.rules.setRules(prev)
+		return nil, fmt.Errorf("%w, %v", errRulesNotSaved, err)
+	}
+	return a.record(r, rev, old, rules.entries), nil
+}
+
+// Reloaded puts rules read again from the rules file in use, recording them when they differ
+func (a *RulesAPI) Reloaded(rules *RuleMap) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	old := a.rules.Entries()
+	a.rules.setRules(rules)
+	if rulesETag(old) != rulesETag(rules.entries) {
+		a.record(&http.Request{}, &ruleRevision{Action: ruleActionReload}, old, rules.entries)
+	}
+}
+
+// writeChangeError answers a failed change, with 412 when If-Match didn't match
+func writeChangeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errRulesChanged):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, errRuleNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errNoRuleHistory):
+		status = http.StatusConflict
+	case errors.Is(err, errRulesNotSaved):
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeRevision(w http.ResponseWriter, rev *ruleRevision) {
+	w.Header().Set("ETag", rev.ETag)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"revision": rev.Revision, "etag": rev.ETag, "changes": rev.Changes})
+}
+
+// handleGet returns the whole rule set, with its ETag
+func (a *RulesAPI) handleGet(w http.ResponseWriter, r *http.Request) {
+	entries := a.rules.Entries()
+	data, _ := json.MarshalIndent(entries, "", "  ")
+	w.Header().Set("ETag", rulesETag(entries))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// handleUpdate replaces the whole rule set
+func (a *RulesAPI) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	var entries map[string]json.RawMessage
+	err := json.Unmarshal(body, &entries)
+	var rev *ruleRevision
+	if err == nil {
+		rev, err = a.change(r, &ruleRevision{Action: ruleActionReplace}, func(m map[string]json.RawMessage) error {
+			for k := range m {
+				delete(m, k)
+			}
+			for k, v := range entries {
+				m[k] = v
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		logger.Warnf("Unable to set host config, error %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errRulesChanged) {
+			status = http.StatusPreconditionFailed
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(fmt.Sprintf("set hosts config error: %v", err)))
+		return
+	}
+	logger.Info("config updated and saved successfully")
+	w.Header().Set("ETag", rev.ETag)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleRule gets (GET), adds or replaces (PUT, the body is the value) or removes (DELETE) the rule of the pattern
+// parameter
+func (a *RulesAPI) handleRule(w http.ResponseWriter, r *http.Request) {
+	pattern := normalizePattern(r.URL.Query().Get("pattern"))
+	if pattern == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "pattern is required"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		entries := a.rules.Entries()
+		value, ok := entries[pattern]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": errRuleNotFound.Error()})
+			return
+		}
+		w.Header().Set("ETag", rulesETag(entries))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"pattern": pattern, "value": value})
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		value := json.RawMessage(bytes.Trim(body, " \t\r\n"))
+		if len(value) == 0 {
+			value = json.RawMessage(`""`)
+		}
+		if !json.Valid(value) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "the body must be a JSON rule value"})
+			return
+		}
+		rev, err := a.change(r, &ruleRevision{Action: ruleActionPut}, func(m map[string]json.RawMessage) error {
+			m[pattern] = value
+			return nil
+		})
+		if err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		writeRevision(w, rev)
+	case http.MethodDelete:
+		rev, err := a.change(r, &ruleRevision{Action: ruleActionDelete}, func(m map[string]json.RawMessage) error {
+			if _, ok := m[pattern]; !ok {
+				return errRuleNotFound
+			}
+			delete(m, pattern)
+			return nil
+		})
+		if err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		writeRevision(w, rev)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "rule needs GET, PUT or DELETE"})
+	}
+}
+
+// handleHistory lists the latest revisions newest first without their rule sets, limit defaults to 50. With a
+// revision parameter it returns that revision, rule set included.
+func (a *RulesAPI) handleHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if a.history == "" {
+		writeChangeError(w, errNoRuleHistory)
+		return
+	}
+	if s := q.Get("revision"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid revision " + s})
+			return
+		}
+		rev, err := a.findRevision(n)
+		if err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rev)
+		return
+	}
+	limit := ruleHistoryDefaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit " + s})
+			return
+		}
+		limit = n
+	}
+	ret := []*ruleRevision{}
+	_, _, err := a.readHistory(func(rev *ruleRevision) bool {
+		rev.Rules = nil
+		ret = append(ret, rev)
+		if len(ret) > limit {
+			ret = ret[1:]
+		}
+		return false
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (a *RulesAPI) findRevision(n uint64) (*ruleRevision, error) {
+	var found *ruleRevision
+	_, _, err := a.readHistory(func(rev *ruleRevision) bool {
+		if rev.Revision == n {
+			found = rev
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: revision %d", errRuleNotFound, n)
+	}
+	return found, nil
+}
+
+// handleRollback puts the rule set of an earlier revision back in use, as a new revision
+func (a *RulesAPI) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "rollback needs POST"})
+		return
+	}
+	if a.history == "" {
+		writeChangeError(w, errNoRuleHistory)
+		return
+	}
+	n, err := strconv.ParseUint(r.URL.Query().Get("revision"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "a numeric revision is required"})
+		return
+	}
+	target, err := a.findRevision(n)
+	if err != nil {
+		writeChangeError(w, err)
+		return
+	}
+	rev, err := a.change(r, &ruleRevision{Action: ruleActionRollback, RollbackTo: n}, func(m map[string]json.RawMessage) error {
+		for k := range m {
+			delete(m, k)
+		}
+		for k, v := range target.Rules {
+			m[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		writeChangeError(w, err)
+		return
+	}
+	writeRevision(w, rev)
+}
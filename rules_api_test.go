@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testRulesAPIRules = `{"yuanshen.com": "", "!api.yuanshen.com": null}`
+
+// testSetConfig overrides global settings for the duration of a test
+func testSetConfig(t *testing.T, settings map[string]interface{}) {
+	for k, v := range settings {
+		old := viper.Get(k)
+		viper.Set(k, v)
+		t.Cleanup(func() {
+			viper.Set(k, old)
+		})
+	}
+}
+
+// testRulesAPI returns a rules API over a rules file in a temporary dir holding rules, and the name of that file
+func testRulesAPI(t *testing.T, rules string, maxLines int) (*RulesAPI, string) {
+	fn := filepath.Join(t.TempDir(), "hosts.json")
+	if err := ioutil.WriteFile(fn, []byte(rules), 0644); err != nil {
+		t.Fatalf("write rules file, err %v", err)
+	}
+	testSetConfig(t, map[string]interface{}{"client.rules": fn, "client.rulesbackups": 2})
+	a := &RulesAPI{rules: testForwardRules(t, rules), history: fn + ".history", maxLines: maxLines}
+	if err := a.load(); err != nil {
+		t.Fatalf("load err %v", err)
+	}
+	return a, fn
+}
+
+// testRulesRequest sends a request to the console endpoints of a
+func testRulesRequest(a *RulesAPI, method, target, ifMatch, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config/update", a.handleUpdate)
+	mux.HandleFunc("/rules/rule", a.handleRule)
+	mux.HandleFunc("/rules/rollback", a.handleRollback)
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// testHistory returns the revisions of the history of a, failing on a torn line
+func testHistory(t *testing.T, a *RulesAPI) []*ruleRevision {
+	ret := []*ruleRevision{}
+	_, torn, err := a.readHistory(func(rev *ruleRevision) bool {
+		ret = append(ret, rev)
+		return false
+	})
+	if err != nil || torn >= 0 {
+		t.Fatalf("readHistory torn %d, err %v", torn, err)
+	}
+	return ret
+}
+
+// testRulesFile returns the rule set saved in fn
+func testRulesFile(t *testing.T, fn string) map[string]json.RawMessage {
+	rules, err := readRuleFile(fn)
+	if err != nil {
+		t.Fatalf("readRuleFile err %v", err)
+	}
+	return rules.entries
+}
+
+func TestRulesAPIChange(t *testing.T) {
+	a, fn := testRulesAPI(t, testRulesAPIRules, 0)
+	loaded := rulesETag(a.rules.Entries())
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"put", http.MethodPut, "/rules/rule?pattern=example.com", loaded, `"10.0.0.5"`, http.StatusOK},
+		// the rule set isn't the one loaded anymore
+		{"put with a stale If-Match", http.MethodPut, "/rules/rule?pattern=example.net", loaded, `""`, http.StatusPreconditionFailed},
+		{"replace with a stale If-Match", http.MethodPost, "/config/update", loaded, `{}`, http.StatusPreconditionFailed},
+		{"rollback with a stale If-Match", http.MethodPost, "/rules/rollback?revision=1", loaded, "", http.StatusPreconditionFailed},
+		{"put without If-Match", http.MethodPut, "/rules/rule?pattern=example.net", "", `""`, http.StatusOK},
+		{"invalid value", http.MethodPut, "/rules/rule?pattern=example.org", "", `{"target": 5}`, http.StatusBadRequest},
+		{"invalid json", http.MethodPut, "/rules/rule?pattern=example.org", "", `{`, http.StatusBadRequest},
+		{"invalid pattern", http.MethodPut, "/rules/rule?pattern=*.", "", `""`, http.StatusBadRequest},
+		{"delete missing", http.MethodDelete, "/rules/rule?pattern=example.org", "*", "", http.StatusNotFound},
+		{"delete", http.MethodDelete, "/rules/rule?pattern=example.net", "*", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		before := a.rules.Entries()
+		w := testRulesRequest(a, tt.method, tt.target, tt.ifMatch, tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d, %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		after := a.rules.Entries()
+		if tt.status != http.StatusOK && !reflect.DeepEqual(before, after) {
+			t.Errorf("%s: refused, but the rules changed to %v", tt.name, after)
+		}
+		if tt.status == http.StatusOK && w.Header().Get("ETag") != rulesETag(after) {
+			t.Errorf("%s: ETag %s, want %s", tt.name, w.Header().Get("ETag"), rulesETag(after))
+		}
+		if saved := testRulesFile(t, fn); !reflect.DeepEqual(saved, after) {
+			t.Errorf("%s: saved %v, in use %v", tt.name, saved, after)
+		}
+	}
+	want := map[string]json.RawMessage{
+		"yuanshen.com":      json.RawMessage(`""`),
+		"!api.yuanshen.com": json.RawMessage(`null`),
+		"example.com":       json.RawMessage(`"10.0.0.5"`),
+	}
+	if got := a.rules.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("rules %v, want %v", got, want)
+	}
+	actions := []string{}
+	for _, rev := range testHistory(t, a) {
+		actions = append(actions, rev.Action)
+	}
+	if want := []string{ruleActionLoad, ruleActionPut, ruleActionPut, ruleActionDelete}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("history %v, want %v", actions, want)
+	}
+}
+
+func TestRulesAPISaveFailure(t *testing.T) {
+	a, fn := testRulesAPI(t, testRulesAPIRules, 0)
+	before := a.rules.Entries()
+	// the temporary file can't be created next to it
+	testSetConfig(t, map[string]interface{}{"client.rules": filepath.Join(filepath.Dir(fn), "missing", "hosts.json")})
+	w := testRulesRequest(a, http.MethodPut, "/rules/rule?pattern=example.com", "", `""`)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if after := a.rules.Entries(); !reflect.DeepEqual(before, after) {
+		t.Errorf("rules in use %v, want them reverted to %v", after, before)
+	}
+	if a.rules.MatchHost("example.com") != nil {
+		t.Errorf("the unsaved rule is still matched")
+	}
+	if n := len(testHistory(t, a)); n != 1 {
+		t.Errorf("%d revisions, want only the load", n)
+	}
+}
+
+func TestRulesAPIRollback(t *testing.T) {
+	a, _ := testRulesAPI(t, testRulesAPIRules, 0)
+	loaded := a.rules.Entries()
+	for _, pattern := range []string{"example.com", "example.net"} {
+		if w := testRulesRequest(a, http.MethodPut, "/rules/rule?pattern="+pattern, "", `""`); w.Code != http.StatusOK {
+			t.Fatalf("put %s: status %d", pattern, w.Code)
+		}
+	}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{"get", http.MethodGet, "/rules/rollback?revision=1", http.StatusMethodNotAllowed},
+		{"no revision", http.MethodPost, "/rules/rollback", http.StatusBadRequest},
+		{"invalid revision", http.MethodPost, "/rules/rollback?revision=first", http.StatusBadRequest},
+		{"unknown revision", http.MethodPost, "/rules/rollback?revision=99", http.StatusNotFound},
+		{"rollback", http.MethodPost, "/rules/rollback?revision=1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := testRulesRequest(a, tt.method, tt.target, "", ""); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d, %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+	if got := a.rules.Entries(); !reflect.DeepEqual(got, loaded) {
+		t.Errorf("rules %v after the rollback, want %v", got, loaded)
+	}
+	history := testHistory(t, a)
+	last := history[len(history)-1]
+	if len(history) != 4 || last.Action != ruleActionRollback || last.RollbackTo != 1 || last.Revision != 4 || len(last.Changes) != 2 {
+		t.Errorf("last revision %+v of %d", last, len(history))
+	}
+}
+
+func TestRulesHistoryTornLine(t *testing.T) {
+	a, _ := testRulesAPI(t, testRulesAPIRules, 0)
+	testRulesRequest(a, http.MethodPut, "/rules/rule?pattern=example.com", "", `""`)
+	complete, err := ioutil.ReadFile(a.history)
+	if err != nil {
+		t.Fatalf("read history, err %v", err)
+	}
+	tests := []struct {
+		name string
+		tail string
+		ok   bool
+	}{
+		{"complete", "", true},
+		{"torn last line", `{"revision":3,"time":"2026-`, true},
+		{"torn last line with newline", "{\"revision\":3,\n", true},
+		{"corrupt line before the last", "garbage\n" + string(bytes.SplitAfter(complete, []byte("\n"))[1]), false},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(a.history, append(append([]byte{}, complete...), tt.tail...), 0644); err != nil {
+			t.Fatalf("write history, err %v", err)
+		}
+		reloaded := &RulesAPI{rules: a.rules, history: a.history}
+		err := reloaded.load()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: load err %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if data, _ := ioutil.ReadFile(a.history); !bytes.Equal(data, complete) {
+			t.Errorf("%s: history not cut back to its complete lines, %q", tt.name, data)
+		}
+		if reloaded.revision != 2 || reloaded.lines != 2 {
+			t.Errorf("%s: revision %d, %d lines", tt.name, reloaded.revision, reloaded.lines)
+		}
+		// the next revision goes on a line of its own
+		testRulesRequest(reloaded, http.MethodPut, "/rules/rule?pattern=example.net", "", `""`)
+		if history := testHistory(t, reloaded); len(history) != 3 || history[2].Revision != 3 {
+			t.Errorf("%s: %d revisions after a change", tt.name, len(history))
+		}
+		testRulesRequest(reloaded, http.MethodDelete, "/rules/rule?pattern=example.net", "", "")
+	}
+}
+
+func TestRulesHistoryTrim(t *testing.T) {
+	a, _ := testRulesAPI(t, testRulesAPIRules, 4)
+	for i := 0; i < 12; i++ {
+		value := `"10.0.0.` + string(rune('1'+i%8)) + `"`
+		if w := testRulesRequest(a, http.MethodPut, "/rules/rule?pattern=example.com", "", value); w.Code != http.StatusOK {
+			t.Fatalf("put %s: status %d", value, w.Code)
+		}
+		// trimmed back to 4 once it holds more than 5
+		if history := testHistory(t, a); len(history) > 5 || len(history) != a.lines {
+			t.Fatalf("after %d changes: %d revisions, %d counted", i+1, len(history), a.lines)
+		}
+	}
+	history := testHistory(t, a)
+	for i, rev := range history {
+		if want := uint64(13 - len(history) + 1 + i); rev.Revision != want {
+			t.Errorf("revision %d at %d, want %d", rev.Revision, i, want)
+		}
+	}
+	if fi, err := os.Stat(a.history); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("trimmed history %v, err %v", fi, err)
+	}
+}
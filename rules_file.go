@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backups of the rules file are named <file>.<time>.bak, the time format sorts by name
+const ruleBackupTimeFormat = "20060102-150405.000000"
+
+// writeFileAtomic replaces fn with data so that a crash leaves either the old or the new content: the data goes to a
+// temporary file in the same directory first, which is synced and then renamed over fn
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fn); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes a rename in dir durable, where the platform supports it
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// ruleBackups lists the backups of a rules file, newest first
+func ruleBackups(fn string) []string {
+	matches, _ := filepath.Glob(fn + ".*.bak")
+	ret := []string{}
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, fn+"."), ".bak")
+		if _, err := time.Parse(ruleBackupTimeFormat, stamp); err == nil {
+			ret = append(ret, m)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ret)))
+	return ret
+}
+
+// backupRuleFile keeps the current content of fn as a timestamped backup, and removes the oldest backups beyond keep
+func backupRuleFile(fn string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.%s.bak", fn, time.Now().Format(ruleBackupTimeFormat))
+	if err := writeFileAtomic(backup, data, 0644); err != nil {
+		return err
+	}
+	backups := ruleBackups(fn)
+	if len(backups) <= keep {
+		return nil
+	}
+	for _, old := range backups[keep:] {
+		if err := os.Remove(old); err != nil {
+			logger.Warnf("Unable to remove old rules backup %s, err %v", old, err)
+		}
+	}
+	return nil
+}
+
+// saveRuleFile writes a rules file atomically, after backing up the version it replaces
+func saveRuleFile(fn string, data []byte, keep int) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(fn); err == nil {
+		// older versions created the file executable
+		perm = fi.Mode().Perm() &^ 0111
+	}
+	if err := backupRuleFile(fn, keep); err != nil {
+		return fmt.Errorf("unable to back up %s, %w", fn, err)
+	}
+	return writeFileAtomic(fn, data, perm)
+}
+
+// loadRuleFile reads the rules file, falling back to the newest backup that parses when the file itself is missing or
+// corrupt
+func loadRuleFile(name string) (*RuleMap, error) {
+	rules, err := readRuleFile(name)
+	if err == nil {
+		return rules, nil
+	}
+	fn := GetFileLocation(name)
+	for _, backup := range ruleBackups(fn) {
+		data, berr := ioutil.ReadFile(backup)
+		if berr != nil {
+			continue
+		}
+		if rules, berr := parseRuleMap(data); berr == nil {
+			logger.Errorw("RULES FILE UNUSABLE, RUNNING ON A BACKUP. Check and fix the rules file, the next change "+
+				"through the console overwrites it", "file", fn, "err", err, "backup", backup)
+			return rules, nil
+		}
+		logger.Warnf("Rules backup %s is not usable either", backup)
+	}
+	return nil, err
+}
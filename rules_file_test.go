@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRuleBackup writes a backup of fn as if it was made age ago
+func testRuleBackup(t *testing.T, fn string, age time.Duration, data string) string {
+	backup := fmt.Sprintf("%s.%s.bak", fn, time.Now().Add(-age).Format(ruleBackupTimeFormat))
+	if err := ioutil.WriteFile(backup, []byte(data), 0644); err != nil {
+		t.Fatalf("write backup, err %v", err)
+	}
+	return backup
+}
+
+func TestRuleBackups(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "hosts.json")
+	older := testRuleBackup(t, fn, time.Hour, "{}")
+	newer := testRuleBackup(t, fn, time.Minute, "{}")
+	// not backups of fn
+	for _, other := range []string{fn + ".old.bak", fn + ".history", fn + "2.20260101-000000.000000.bak", fn + ".bak"} {
+		if err := ioutil.WriteFile(other, []byte("{}"), 0644); err != nil {
+			t.Fatalf("write %s, err %v", other, err)
+		}
+	}
+	if got := ruleBackups(fn); !reflect.DeepEqual(got, []string{newer, older}) {
+		t.Errorf("ruleBackups = %v, want %v", got, []string{newer, older})
+	}
+}
+
+func TestBackupRuleFile(t *testing.T) {
+	tests := []struct {
+		keep    int
+		saves   int
+		backups int
+	}{
+		{0, 3, 0},
+		{1, 3, 1},
+		{2, 1, 0},
+		{2, 2, 1},
+		{2, 5, 2},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), "hosts.json")
+		for i := 0; i < tt.saves; i++ {
+			if err := saveRuleFile(fn, []byte(fmt.Sprintf(`{"v%d.example.com": ""}`, i)), tt.keep); err != nil {
+				t.Fatalf("keep %d: saveRuleFile err %v", tt.keep, err)
+			}
+			// backups are told apart by their time
+			time.Sleep(time.Millisecond)
+		}
+		backups := ruleBackups(fn)
+		if len(backups) != tt.backups {
+			t.Errorf("keep %d, %d saves: %d backups, want %d", tt.keep, tt.saves, len(backups), tt.backups)
+			continue
+		}
+		// the newest backups are kept, each holding the version its save replaced
+		for i, backup := range backups {
+			data, _ := ioutil.ReadFile(backup)
+			if want := fmt.Sprintf(`{"v%d.example.com": ""}`, tt.saves-2-i); string(data) != want {
+				t.Errorf("keep %d, %d saves: backup %d holds %s, want %s", tt.keep, tt.saves, i, data, want)
+			}
+		}
+	}
+}
+
+func TestSaveRuleFilePermissions(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "hosts.json")
+	if err := ioutil.WriteFile(fn, []byte("{}"), 0750); err != nil {
+		t.Fatalf("write rules file, err %v", err)
+	}
+	if err := saveRuleFile(fn, []byte(`{"example.com": ""}`), 1); err != nil {
+		t.Fatalf("saveRuleFile err %v", err)
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("saved rules file %v, err %v, want mode 0640", fi, err)
+	}
+}
+
+func TestLoadRuleFile(t *testing.T) {
+	const valid, corrupt = `{"example.com": ""}`, `{"example.com": `
+	tests := []struct {
+		name    string
+		file    string // empty for no file
+		backups []string
+		pattern string // the pattern of the rules loaded, empty for an error
+	}{
+		{"valid", valid, []string{`{"backup.example.com": ""}`}, "example.com"},
+		{"corrupt, newer backup corrupt too", corrupt, []string{`{"older.example.com": ""}`, corrupt}, "older.example.com"},
+		{"corrupt, both backups usable", corrupt, []string{`{"older.example.com": ""}`, `{"newer.example.com": ""}`}, "newer.example.com"},
+		{"invalid rule", `{"*.": ""}`, []string{`{"older.example.com": ""}`}, "older.example.com"},
+		{"missing", "", []string{`{"older.example.com": ""}`}, "older.example.com"},
+		{"corrupt without usable backups", corrupt, []string{corrupt, `{"!x": "target"}`}, ""},
+		{"missing without backups", "", nil, ""},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), "hosts.json")
+		if tt.file != "" {
+			if err := ioutil.WriteFile(fn, []byte(tt.file), 0644); err != nil {
+				t.Fatalf("write rules file, err %v", err)
+			}
+		}
+		// oldest first
+		for i, backup := range tt.backups {
+			testRuleBackup(t, fn, time.Duration(len(tt.backups)-i)*time.Hour, backup)
+		}
+		rules, err := loadRuleFile(fn)
+		if tt.pattern == "" {
+			if err == nil {
+				t.Errorf("%s: loadRuleFile = %v, want an error", tt.name, rules.entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: loadRuleFile err %v", tt.name, err)
+			continue
+		}
+		if _, ok := rules.entries[tt.pattern]; !ok || len(rules.entries) != 1 {
+			t.Errorf("%s: loaded %v, want %s", tt.name, rules.entries, tt.pattern)
+		}
+	}
+	if rules, err := loadRuleFile(""); rules != nil || err != nil {
+		t.Errorf("no rules file: loadRuleFile = %v, %v", rules, err)
+	}
+}
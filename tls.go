@@ -27,12 +27,16 @@ const (
 	tlsTypeMessageKeyUpdate           uint8 = 24
 	tlsTypeMessageMessageHash         uint8 = 254
 	extensionIDServerName             int   = 0
+	tlsMaxRecordLen                         = 1<<14 + 2048 // maximum TLSCiphertext length allowed by RFC 8446
+	tlsMaxPlaintextLen                      = 1 << 14
+	tlsMaxHandshakeMessageLen               = 1 << 16 // large enough for any sane ClientHello, including post-quantum key shares
 )
 
 type tlsConn struct {
 	conn          net.Conn
 	readBuffer    []byte
 	versionBuffer []byte
+	rawBuffer     []byte // original records backing readBuffer, nil once readBuffer no longer starts at a record boundary
 }
 
 type tlsMessage struct {
@@ -40,6 +44,7 @@ type tlsMessage struct {
 	data        []byte
 	IsHandShake bool
 	version     []byte // optional, used to keep tls version for handshake packet
+	raw         []byte // optional, the original records carrying a handshake message
 }
 
 func makeNetworkInt(d []byte) int {
@@ -98,47 +103,57 @@ func writeWithlogging(logtype string, c net.Conn, data []byte) error {
 	return nil
 }
 
+// readRecord reads a whole TLS record from the connection, returning its 5 bytes header and the body
+func (c *tlsConn) readRecord() ([]byte, []byte, error) {
+	head := make([]byte, 5)
+	if err := readWithlogging("head", c.conn, head); err != nil {
+		return nil, nil, err
+	}
+	// check  TLS version
+	if head[1] != 3 {
+		logger.Warnf("Invalid TLS version %d,%d from remote %s", head[1], head[2], c.conn.RemoteAddr().String())
+		return nil, nil, errInvalidTLSPacket
+	}
+	logger.Debugf("tls record length %d", makeNetworkInt(head[3:5]))
+	if makeNetworkInt(head[3:5]) > tlsMaxRecordLen {
+		logger.Warnf("TLS record length %d from remote %s exceeds the limit", makeNetworkInt(head[3:5]), c.conn.RemoteAddr().String())
+		return nil, nil, errInvalidTLSPacket
+	}
+	body := make([]byte, makeNetworkInt(head[3:5]))
+	if err := readWithlogging("body", c.conn, body); err != nil {
+		return nil, nil, err
+	}
+	return head, body, nil
+}
+
 func (c *tlsConn) ReadMessage() (*tlsMessage, error) {
 	if len(c.readBuffer) == 0 {
 		// Nothing in buffer, try to read somthing
-		head := make([]byte, 5)
-		if err := readWithlogging("head", c.conn, head); err != nil {
+		head, body, err := c.readRecord()
+		if err != nil {
 			return nil, err
 		}
-		// check  TLS version
-		if head[1] != 3 {
-			logger.Warnf("Invalid TLS version %d,%d from remote %s", head[1], head[2], c.conn.RemoteAddr().String())
-			return nil, errInvalidTLSPacket
-		}
 
 		c.versionBuffer = make([]byte, 2)
 		c.versionBuffer[0] = head[1]
 		c.versionBuffer[1] = head[2]
 
-		logger.Debugf("tls record length %d", makeNetworkInt(head[3:5]))
 		if head[0] == tlsTypeRecordAlert || head[0] == tlsTypeRecordChangeCiperSpec || head[0] == tlsTypeRecordApplicationData {
-			// Read rest and create a message immediately
-			body := make([]byte, makeNetworkInt(head[3:5]))
-			if err := readWithlogging("body", c.conn, body); err != nil {
-				return nil, err
-			}
+			// create a message immediately
 			return newMessage(head, body, false), nil
 		}
 		if head[0] != tlsTypeRecordHandShake {
 			// Invalid TLS packet, reject
-			logger.Warn("Expect handshake from %s, got a %d, rejecting", c.conn.RemoteAddr().String(), head[0])
+			logger.Warnf("Expect handshake from %s, got a %d, rejecting", c.conn.RemoteAddr().String(), head[0])
 			return nil, errInvalidTLSPacket
 		}
-		// Otherwise, read the tls body into readbuffer
-		c.readBuffer = make([]byte, makeNetworkInt(head[3:5]))
-		if err := readWithlogging("message body", c.conn, c.readBuffer); err != nil {
-			logger.Warn("Read handshake body failed in Readmessage")
-			return nil, err
-		}
+		// Otherwise, keep the tls body in readbuffer, and the original record in case the message ends with it
+		c.readBuffer = body
+		c.rawBuffer = append(head, body...)
 	}
 	logger.Debugf("About to parse read buffer %v", c.readBuffer)
-	if len(c.readBuffer) < 4 {
-		logger.Warn("Handshake message shorter than 4 bytes")
+	if len(c.readBuffer) == 0 {
+		logger.Warn("Empty handshake record")
 		return nil, errInvalidTLSPacket
 	}
 	// Parse a handshake message out of the readbuffer, handshake header is useless though
@@ -165,17 +180,41 @@ func (c *tlsConn) ReadMessage() (*tlsMessage, error) {
 		logger.Warnf("Invalid type of TLS handshake %d", c.readBuffer[0])
 		return nil, errInvalidTLSPacket
 	}
-	bodylen := makeNetworkInt(c.readBuffer[1:4])
-	if len(c.readBuffer) < bodylen+4 {
-		// TODO: This is not an errror, just hard to handle, return failure for now
-		logger.Error("Cross record handshake message, take it as an error now")
-		return nil, errInvalidTLSPacket
+	// A handshake message could be fragmented into several records (large ClientHello with big key shares or
+	// padding for example), keep reading records until both the message header and the body are complete
+	for len(c.readBuffer) < 4 || len(c.readBuffer) < 4+makeNetworkInt(c.readBuffer[1:4]) {
+		if len(c.readBuffer) >= 4 && makeNetworkInt(c.readBuffer[1:4]) > tlsMaxHandshakeMessageLen {
+			logger.Warnf("Handshake message length %d from %s exceeds the limit", makeNetworkInt(c.readBuffer[1:4]), c.conn.RemoteAddr().String())
+			return nil, errInvalidTLSPacket
+		}
+		head, body, err := c.readRecord()
+		if err != nil {
+			logger.Warn("Read continuation record failed in Readmessage")
+			return nil, err
+		}
+		// Handshake fragments must not be interleaved with other record types
+		if head[0] != tlsTypeRecordHandShake {
+			logger.Warnf("Expect handshake continuation from %s, got a %d, rejecting", c.conn.RemoteAddr().String(), head[0])
+			return nil, errInvalidTLSPacket
+		}
+		logger.Debugf("Reassembling handshake message from %s, got %d more bytes", c.conn.RemoteAddr(), len(body))
+		c.readBuffer = append(c.readBuffer, body...)
+		if c.rawBuffer != nil {
+			c.rawBuffer = append(append(c.rawBuffer, head...), body...)
+		}
 	}
+	bodylen := makeNetworkInt(c.readBuffer[1:4])
 	head := c.readBuffer[0:4]
 	body := c.readBuffer[4 : 4+bodylen]
 	c.readBuffer = c.readBuffer[4+bodylen:]
 	ret := newMessage(head, body, true)
 	ret.version = c.versionBuffer
+	if len(c.readBuffer) == 0 {
+		// The message ends exactly where the records end, so the original records could be forwarded as is
+		ret.raw = c.rawBuffer
+	}
+	// Whatever remains does not start at a record boundary any more
+	c.rawBuffer = nil
 	logger.Debugf("Received a type %d packet from %v, %d bytes left in readbuffer", ret.Type(), c.conn.RemoteAddr(), len(c.readBuffer))
 	return ret, nil
 }
@@ -189,29 +228,38 @@ func (p *tlsMessage) LogForError(s string) {
 }
 
 func (c *tlsConn) WriteMessage(m *tlsMessage) error {
+	if m.IsHandShake && m.raw != nil {
+		// 原始的 record 还在，原样转发
+		return writeWithlogging("records", c.conn, m.raw)
+	}
 	if m.IsHandShake {
-		// 自己做一个 TLS handshake packet
-		head := make([]byte, 5)
-		head[0] = tlsTypeRecordHandShake
-		if len(m.version) == 2 {
-			head[1] = m.version[0]
-			head[2] = m.version[1]
-		} else {
-			head[1] = 3
-			head[2] = 3
-		}
-		writeNetworkInt(head[3:5], len(m.head)+len(m.data))
-		err := writeWithlogging("head", c.conn, head)
-		if err != nil {
-			return err
-		}
-		err = writeWithlogging("message head", c.conn, m.head)
-		if err != nil {
-			return err
-		}
-		err = writeWithlogging("message body", c.conn, m.data)
-		if err != nil {
-			return err
+		// 自己做 TLS handshake record, 消息太长的话要拆成多个 record
+		data := make([]byte, 0, len(m.head)+len(m.data))
+		data = append(append(data, m.head...), m.data...)
+		for len(data) > 0 {
+			fragment := data
+			if len(fragment) > tlsMaxPlaintextLen {
+				fragment = fragment[:tlsMaxPlaintextLen]
+			}
+			data = data[len(fragment):]
+			head := make([]byte, 5)
+			head[0] = tlsTypeRecordHandShake
+			if len(m.version) == 2 {
+				head[1] = m.version[0]
+				head[2] = m.version[1]
+			} else {
+				head[1] = 3
+				head[2] = 3
+			}
+			writeNetworkInt(head[3:5], len(fragment))
+			err := writeWithlogging("head", c.conn, head)
+			if err != nil {
+				return err
+			}
+			err = writeWithlogging("message fragment", c.conn, fragment)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
 		// TLS Record 比较简单，直接把 head 和 body 都写出去就好了
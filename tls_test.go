@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// testClientHello returns the ClientHello handshake message crypto/tls sends for serverName
+func testClientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(server, head); err != nil {
+		t.Fatalf("read ClientHello record, err %v", err)
+	}
+	body := make([]byte, makeNetworkInt(head[3:5]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("read ClientHello record, err %v", err)
+	}
+	return body
+}
+
+// testRecords splits data into records of the given type carrying at most size bytes each
+func testRecords(recordType byte, data []byte, size int) []byte {
+	ret := []byte{}
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		ret = append(ret, recordType, 3, 1)
+		ret = appendNetworkInt(ret, n, 2)
+		ret = append(ret, data[:n]...)
+		data = data[n:]
+	}
+	return ret
+}
+
+// testReadMessage feeds stream to a tlsConn and reads one message from it
+func testReadMessage(stream []byte) (*tlsMessage, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(stream)
+		client.Close()
+	}()
+	defer server.Close()
+	c := &tlsConn{
+		conn:          server,
+		readBuffer:    []byte{},
+		versionBuffer: []byte{},
+	}
+	return c.ReadMessage()
+}
+
+func TestReadMessageReassembly(t *testing.T) {
+	hello := testClientHello(t, "www.example.com")
+	for _, size := range []int{len(hello), 512, 100, 3, 1} {
+		stream := testRecords(tlsTypeRecordHandShake, hello, size)
+		p, err := testReadMessage(stream)
+		if err != nil {
+			t.Errorf("records of %d bytes: ReadMessage err %v", size, err)
+			continue
+		}
+		if !p.IsHandShake || p.Type() != tlsTypeMessageClientHello || !bytes.Equal(append(p.head, p.data...), hello) {
+			t.Errorf("records of %d bytes: got a different message", size)
+			continue
+		}
+		if !bytes.Equal(p.raw, stream) {
+			t.Errorf("records of %d bytes: the original records are not kept", size)
+		}
+		if name, err := p.ExtractSNI(); err != nil || name != "www.example.com" {
+			t.Errorf("records of %d bytes: ExtractSNI = %q, %v", size, name, err)
+		}
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	hello := testClientHello(t, "www.example.com")
+	oversized := append([]byte{tlsTypeMessageClientHello}, 0x02, 0x00, 0x00)
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"empty", []byte{}, io.EOF},
+		{"truncated record header", []byte{tlsTypeRecordHandShake, 3, 1}, io.ErrUnexpectedEOF},
+		{"truncated record body", testRecords(tlsTypeRecordHandShake, hello, len(hello))[:100], io.ErrUnexpectedEOF},
+		{"not TLS", []byte("GET / HTTP/1.1\r\n\r\n"), errInvalidTLSPacket},
+		{"record too long", []byte{tlsTypeRecordHandShake, 3, 1, 0xff, 0xff}, errInvalidTLSPacket},
+		{"unknown record type", testRecords(0x18, hello, len(hello)), errInvalidTLSPacket},
+		{"empty handshake record", []byte{tlsTypeRecordHandShake, 3, 1, 0, 0}, errInvalidTLSPacket},
+		{"unknown handshake type", testRecords(tlsTypeRecordHandShake, []byte{0x63, 0, 0, 1, 0}, 5), errInvalidTLSPacket},
+		{"handshake message too long", testRecords(tlsTypeRecordHandShake, oversized, 4), errInvalidTLSPacket},
+		{"message cut short", testRecords(tlsTypeRecordHandShake, hello[:len(hello)-10], 100), io.EOF},
+		{"interleaved alert", append(testRecords(tlsTypeRecordHandShake, hello[:100], 100),
+			testRecords(tlsTypeRecordAlert, []byte{2, 40}, 2)...), errInvalidTLSPacket},
+	}
+	for _, tt := range tests {
+		if _, err := testReadMessage(tt.stream); !errors.Is(err, tt.err) {
+			t.Errorf("%s: ReadMessage err %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadMessageRecord(t *testing.T) {
+	p, err := testReadMessage(testRecords(tlsTypeRecordApplicationData, []byte("data"), 4))
+	if err != nil || p.IsHandShake || p.Type() != tlsTypeRecordApplicationData || string(p.data) != "data" {
+		t.Errorf("application data record: got %v, err %v", p, err)
+	}
+}
+
+func TestExtractSNI(t *testing.T) {
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"xn--fsqu00a.example", "xn--fsqu00a.example"},
+		// no server_name extension is sent for addresses
+		{"192.0.2.1", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		hello := testClientHello(t, tt.serverName)
+		p := newMessage(hello[:4], hello[4:], true)
+		if name, err := p.ExtractSNI(); err != nil || name != tt.want {
+			t.Errorf("ExtractSNI for %q = %q, %v", tt.serverName, name, err)
+		}
+	}
+}
+
+func TestExtractSNITruncated(t *testing.T) {
+	hello := testClientHello(t, "www.example.com")
+	body := hello[4:]
+	sessionID, cipherSuites, compression, extensions := testHelloOffsets(body)
+	// every truncation is refused, except the one cutting exactly before the extensions, which are optional
+	for n := 0; n < len(body); n++ {
+		head := []byte{tlsTypeMessageClientHello, 0, 0, 0}
+		writeNetworkInt(head[1:4], n)
+		name, err := newMessage(head, body[:n], true).ExtractSNI()
+		if n == extensions {
+			if err != nil || name != "" {
+				t.Errorf("without extensions: ExtractSNI = %q, %v", name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("truncated to %d of %d bytes: ExtractSNI = %q, want an error", n, len(body), name)
+		}
+	}
+	// lengths pointing past the end
+	for _, off := range []int{sessionID, cipherSuites, compression, extensions} {
+		corrupt := append([]byte{}, body...)
+		corrupt[off] = 0xff
+		if name, err := newMessage(hello[:4], corrupt, true).ExtractSNI(); err == nil {
+			t.Errorf("length at %d corrupted: ExtractSNI = %q, want an error", off, name)
+		}
+	}
+	if _, err := newMessage([]byte{tlsTypeMessageServerHello, 0, 0, 0}, []byte{}, true).ExtractSNI(); err == nil {
+		t.Errorf("ServerHello: ExtractSNI wants an error")
+	}
+}
+
+// testHelloOffsets returns where the length fields of a ClientHello body are
+func testHelloOffsets(body []byte) (sessionID, cipherSuites, compression, extensions int) {
+	sessionID = 2 + 32
+	cipherSuites = sessionID + 1 + int(body[sessionID])
+	compression = cipherSuites + 2 + makeNetworkInt(body[cipherSuites:cipherSuites+2])
+	extensions = compression + 1 + int(body[compression])
+	return
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamDialer holds the *net.Dialer for upstream connections, it is replaced when global.outip changes
+var upstreamDialer atomic.Value
+
+// newDialer builds the upstream dialer, bound to outip unless empty
+func newDialer(outip string) (*net.Dialer, error) {
+	ret := &net.Dialer{
+		Timeout: time.Second * 15,
+	}
+	if outip != "" {
+		ip := net.ParseIP(outip)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid outgoing IP %s specified", outip)
+		}
+		ret.LocalAddr = &net.TCPAddr{
+			IP:   ip,
+			Port: 0,
+			Zone: "",
+		}
+	}
+	return ret, nil
+}
+
+func currentDialer() *net.Dialer {
+	return upstreamDialer.Load().(*net.Dialer)
+}
+
+// dialUpstream connects to the target of a proxied connection, or to an upstream proxy. The host part is resolved by
+// the dedicated resolver so that hijacked names won't point back to rproxy, every resolved address is tried in order.
+// Targets have to pass the destination policy, proxies are configured by the admin and are not checked.
+func dialUpstream(ctx context.Context, network, address string, target bool) (net.Conn, error) {
+	ips, port, err := resolveUpstream(ctx, address, target)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := currentDialer().DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// resolveUpstream resolves the host part of address with the dedicated resolver, and refuses addresses looping back
+// to rproxy, or blocked by the destination policy when target is set
+func resolveUpstream(ctx context.Context, address string, target bool) ([]net.IP, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", err
+	}
+	ips, err := resolver.LookupIP(ctx, host)
+	if err != nil {
+		logger.Infow("resolve upstream fail", "host", host, "err", err)
+		return nil, "", err
+	}
+	portNum, _ := strconv.Atoi(port)
+	for _, ip := range ips {
+		if loopDetector.IsLoop(ip, portNum) {
+			logger.Warnw("forwarding loop detected", "target", address, "ip", ip.String())
+			return nil, "", errForwardLoop
+		}
+	}
+	if target {
+		if err := currentDestinationPolicy().Check(ctx, address, ips); err != nil {
+			return nil, "", err
+		}
+	}
+	return ips, port, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const upstreamDirect = "direct"
+
+var (
+	// upstreamProxy is the default route for upstream connections, empty to connect directly
+	upstreamProxy string
+)
+
+type upstreamViaKey struct{}
+
+// parseUpstreamProxy validates a proxy url, socks5://[user:pass@]host:port or http://[user:pass@]host:port.
+// socks5h:// is socks5 with the target name resolved by the proxy. "direct" is accepted as well, meaning no proxy.
+func parseUpstreamProxy(s string) (string, error) {
+	s = strings.Trim(s, " ")
+	if s == "" || s == upstreamDirect {
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		u.Host = ensurePort(u.Host, "1080")
+	case "http":
+		u.Host = ensurePort(u.Host, "80")
+	default:
+		return "", fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("upstream proxy %q has no host", s)
+	}
+	return u.String(), nil
+}
+
+func setupUpstreamProxy() {
+	p, err := parseUpstreamProxy(viper.GetString("upstream.proxy"))
+	if err != nil {
+		logger.Fatalf("Invalid upstream.proxy, err %v", err)
+		return
+	}
+	if p == upstreamDirect {
+		p = ""
+	}
+	upstreamProxy = p
+}
+
+// withUpstreamVia attaches the route of a request, so that the http transport dials through the right proxy
+func withUpstreamVia(ctx context.Context, via string) context.Context {
+	return context.WithValue(ctx, upstreamViaKey{}, via)
+}
+
+func upstreamVia(ctx context.Context) string {
+	if via, ok := ctx.Value(upstreamViaKey{}).(string); ok {
+		return via
+	}
+	return upstreamProxy
+}
+
+// dialVia connects to address through the proxy via, or directly when via is empty. The proxy itself is reached
+// with dialUpstream. socks5 and http proxies are given the target resolved by rproxy, an address checked like a direct
+// connection. A socks5h proxy resolves the target name itself, which bypasses the destination policy for names, only
+// an address given literally can be held against it.
+func dialVia(ctx context.Context, via string, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dialViaRoute(ctx, via, network, address)
+	route := "direct"
+	if u, perr := url.Parse(via); via != "" && perr == nil {
+		route = u.Host
+	}
+	metrics.ObserveDial(route, start, err)
+	return conn, err
+}
+
+func dialViaRoute(ctx context.Context, via string, network, address string) (net.Conn, error) {
+	if via == "" {
+		return dialUpstream(ctx, network, address, true)
+	}
+	proxy, err := url.Parse(via)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "socks5h" {
+		if ip := net.ParseIP(hostOnly(address)); ip != nil {
+			if err := currentDestinationPolicy().Check(ctx, address, []net.IP{ip}); err != nil {
+				return nil, err
+			}
+		}
+		return dialProxy(ctx, proxy, address)
+	}
+	ips, port, err := resolveUpstream(ctx, address, true)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialProxy(ctx, proxy, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		// the next address is only worth a try when the proxy itself answered that it couldn't reach this one
+		if !errors.Is(err, errUpstreamProxy) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialProxy connects to the proxy and asks it for a tunnel to address
+func dialProxy(ctx context.Context, proxy *url.URL, address string) (net.Conn, error) {
+	conn, err := dialUpstream(ctx, "tcp", proxy.Host, false)
+	if err != nil {
+		logger.Infow("upstream proxy connect fail", "proxy", proxy.Host, "err", err)
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if timeout := currentDialer().Timeout; !ok && timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+	if proxy.Scheme == "http" {
+		conn, err = httpConnect(conn, proxy, address)
+	} else {
+		err = socks5Connect(conn, proxy, address)
+	}
+	if err != nil {
+		conn.Close()
+		logger.Infow("upstream proxy handshake fail", "proxy", proxy.Host, "target", address, "err", err)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect runs a RFC 1928 CONNECT, with RFC 1929 username/password authentication when the url has a user
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("%w: not a socks5 server", errUpstreamProxy)
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.User == nil {
+			return fmt.Errorf("%w: socks5 server wants a password", errUpstreamProxy)
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("%w: socks5 credentials too long", errUpstreamProxy)
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("%w: socks5 authentication rejected", errUpstreamProxy)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable socks5 authentication method", errUpstreamProxy)
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", errUpstreamProxy)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = appendNetworkInt(req, portNum, 2)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("%w: socks5 connect failed with reply %d", errUpstreamProxy, head[1])
+	}
+	// skip the bound address
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("%w: invalid socks5 address type %d", errUpstreamProxy, head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// httpConnect opens a tunnel with the CONNECT method, basic authentication is sent when the url has a user
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: CONNECT answered %s", errUpstreamProxy, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns what a bufio.Reader read ahead before continuing with the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// viaTransport sends each request over an http.Transport of its own route and destination trust, so that pooled
+// connections are never shared between requests meant to go through different upstream proxies, nor handed to a
+// request the destination policy wouldn't have let dial them. A reused connection isn't dialed again, the policy
+// can't check it anymore.
+type viaTransport struct {
+	lock       sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (t *viaTransport) get(via string, trust string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := via + " " + trust
+	if ret, ok := t.transports[key]; ok {
+		return ret
+	}
+	ret := &http.Transport{
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       time.Second * 30,
+		ResponseHeaderTimeout: time.Second * 15,
+		ExpectContinueTimeout: time.Second * 15,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialVia(ctx, via, network, address)
+		},
+	}
+	t.transports[key] = ret
+	return ret
+}
+
+func (t *viaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.get(upstreamVia(req.Context()), destinationTrust(upstreamRule(req.Context()))).RoundTrip(req)
+}
+
+// CloseIdleConnections drops the pooled connections of all routes, they may have been dialed under a destination
+// policy that was replaced since
+func (t *viaTransport) CloseIdleConnections() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}